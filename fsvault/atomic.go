@@ -0,0 +1,152 @@
+package fsvault
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Durability controls how hard Put works to make a write survive a crash or
+// power loss. Writes are always atomic, a reader sees the old or new data
+// but never a partial file.
+type Durability int
+
+const (
+	// DurabilityNone leaves flushing the data to disk to the OS.
+	DurabilityNone Durability = iota
+	// DurabilityFile syncs the data file before it replaces the old one.
+	DurabilityFile
+	// DurabilityDir syncs the data file, and the parent directory after the
+	// rename so the new directory entry is also on disk. Directories created
+	// for the key are synced into their parents too.
+	DurabilityDir
+)
+
+// defaultDurability is the safest, at the cost of two fsyncs per write.
+var defaultDurability = DurabilityDir
+
+// internalPrefix marks files and directories used by the vault itself,
+// rather than data, which List() ignores.
+const internalPrefix = ".fsvault-"
+
+// tempFilePrefix marks in-flight writes.
+const tempFilePrefix = internalPrefix + "tmp-"
+
+// isInternalName returns true if name is an in-flight, or abandoned, write
+// or other vault housekeeping.
+func isInternalName(name string) bool {
+	return strings.HasPrefix(name, internalPrefix)
+}
+
+// writeFileAtomic writes data to a temp file in the same directory as
+// fullPath, then renames it over fullPath.
+func writeFileAtomic(fullPath string, data []byte, perm os.FileMode, durability Durability) error {
+	return writeFileVia(fullPath, data, perm, durability, os.Rename)
+}
+
+// writeFileExclusive writes data to fullPath only if it doesn't already
+// exist, returning fs.ErrExist if it does. Like writeFileAtomic, a reader
+// never sees a partial file.
+func writeFileExclusive(fullPath string, data []byte, perm os.FileMode, durability Durability) error {
+
+	// unlike a rename, a link fails if fullPath exists
+	return writeFileVia(fullPath, data, perm, durability, os.Link)
+}
+
+// writeFileVia writes data to a temp file in the same directory as
+// fullPath, then calls place to move it to fullPath.
+func writeFileVia(fullPath string, data []byte, perm os.FileMode, durability Durability,
+	place func(tmpName string, fullPath string) error) error {
+
+	dir := filepath.Dir(fullPath)
+
+	tmp, err := os.CreateTemp(dir, tempFilePrefix+filepath.Base(fullPath)+"-*")
+	if err != nil {
+		return err
+	}
+
+	// clean up the temp file on any failure. After a rename this is a
+	// no-op, after a link it leaves just fullPath
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if durability >= DurabilityFile {
+		if err = tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	// CreateTemp uses 0600, so match the permissions of a normal write
+	if err = os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+
+	if err = place(tmpName, fullPath); err != nil {
+		return err
+	}
+
+	if durability >= DurabilityDir {
+		return syncDir(dir)
+	}
+
+	return nil
+}
+
+// mkdirAll creates dir and any missing parents. With DurabilityDir the
+// parent of each new directory is synced, from the first that already
+// existed down, so a new key's directories survive a power cut. dir itself
+// is synced after the write.
+func mkdirAll(dir string, perm os.FileMode, durability Durability) error {
+
+	if durability < DurabilityDir {
+		return os.MkdirAll(dir, perm)
+	}
+
+	var created []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || filepath.Dir(d) == d {
+			break
+		}
+		created = append(created, d)
+	}
+
+	if err := os.MkdirAll(dir, perm); err != nil {
+		return err
+	}
+
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := syncDir(filepath.Dir(created[i])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncDir flushes directory entries to disk. Windows can't fsync a
+// directory, and renames there are already durable once they return.
+func syncDir(dir string) error {
+
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
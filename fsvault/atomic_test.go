@@ -0,0 +1,83 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPutDurability(t *testing.T) {
+
+	testCases := []struct {
+		description string
+		durability  Durability
+	}{
+		{
+			description: "durability none",
+			durability:  DurabilityNone,
+		},
+		{
+			description: "durability file",
+			durability:  DurabilityFile,
+		},
+		{
+			description: "durability file and directory",
+			durability:  DurabilityDir,
+		},
+	}
+
+	for _, tc := range testCases {
+
+		testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+		if err != nil {
+			assert.Fail(t, err.Error())
+		}
+		defer os.RemoveAll(testRootDir) // clean up
+
+		v, err := Open(testRootDir, WithDurability(tc.durability), WithFilePerm(0640))
+		assert.Equal(t, nil, err, tc.description)
+
+		// overwrite, so the rename replaces an existing file
+		assert.Equal(t, nil, v.Put("/sub/key1", []byte("old data")), tc.description)
+		assert.Equal(t, nil, v.Put("/sub/key1", []byte("new data")), tc.description)
+
+		data, err := v.Get("/sub/key1")
+		assert.Equal(t, nil, err, tc.description)
+		assert.Equal(t, "new data", string(data), tc.description)
+
+		info, err := os.Stat(filepath.Join(testRootDir, "sub", "key1"))
+		assert.Equal(t, nil, err, tc.description)
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm(), tc.description)
+
+		// a key in new directories
+		assert.Equal(t, nil, v.Put("/new/dir/key2", []byte("new data")), tc.description)
+
+		data, err = v.Get("/new/dir/key2")
+		assert.Equal(t, nil, err, tc.description)
+		assert.Equal(t, "new data", string(data), tc.description)
+
+		// no temp files are left behind
+		entries, _ := os.ReadDir(filepath.Join(testRootDir, "sub"))
+		assert.Equal(t, 1, len(entries), tc.description)
+	}
+}
+
+func TestListIgnoresTempFiles(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	Put(testRootDir, "/key1", []byte("some data"))
+
+	// an abandoned write, e.g. after a crash
+	os.WriteFile(filepath.Join(testRootDir, tempFilePrefix+"key1-123"), []byte("{"), 0644)
+
+	assert.Equal(t, []string{"/key1"}, List(testRootDir, "/"), "list")
+}
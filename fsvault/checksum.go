@@ -0,0 +1,175 @@
+package fsvault
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/thisdougb/go-fsvault/internal/filedata"
+)
+
+// Checksums catch a changed value without needing encryption. Each value
+// is stored with a SHA-256 checksum, which catches disk corruption, or with
+// an integrity key an HMAC-SHA256, which also catches deliberate edits as
+// nobody without the key can make a matching checksum. The checksum covers
+// the vault key and all the stored fields, so a value can't be moved to
+// another key without it showing. A whole file restored from an older
+// revision of the same key has a matching checksum, so isn't caught.
+//
+// Every read verifies the checksum of a value that has one, returning
+// ErrCorrupt if it doesn't match. With checksums on, a value without one is
+// also corrupt, as is a value with only a SHA-256 checksum when there is an
+// integrity key, as anyone could have written them. To turn checksums on for
+// a vault with data, allow unchecked reads while Rotate adds the checksums.
+
+// Checksum kinds, stored as the prefix of FileData.Checksum.
+const (
+	checksumSHA256 = "sha256"
+	checksumHMAC   = "hmac-sha256"
+)
+
+// WithChecksums sets whether values are stored with a SHA-256 checksum.
+// The default is set by FSVAULT_CHECKSUMS.
+func WithChecksums(enabled bool) Option {
+	return func(v *Vault) {
+		v.checksums = enabled
+	}
+}
+
+// WithIntegrityKey sets the key for HMAC-SHA256 checksums, which are stored
+// with each value in place of a SHA-256 checksum. The key is given in the
+// same forms as an encryption key, except a passphrase. The default is set
+// by FSVAULT_INTEGRITY_KEY.
+func WithIntegrityKey(key string) Option {
+	return func(v *Vault) {
+		wipeIntegrityKey(v.integrityKey)
+		v.integrityKey = parseIntegrityKey(key)
+	}
+}
+
+// WithUncheckedReads sets whether values without the checksum the vault
+// writes can be read, while checksums are turned on for existing data. Turn
+// it off once Rotate has added checksums to every value. The default is set
+// by FSVAULT_UNCHECKED_READS.
+func WithUncheckedReads(allowed bool) Option {
+	return func(v *Vault) {
+		v.uncheckedReads = allowed
+	}
+}
+
+// parseIntegrityKey parses an integrity key, nil for "".
+func parseIntegrityKey(key string) *encryptionKey {
+
+	if key == "" {
+		return nil
+	}
+
+	k := parseKey(key)
+
+	return &k
+}
+
+// validateIntegrityKey returns ErrInvalidConfig if k can't be used.
+func validateIntegrityKey(k *encryptionKey) error {
+
+	if k != nil && (k.passphrase != "" || !k.valid()) {
+		return fmt.Errorf("%w: integrity key is not a valid key", ErrInvalidConfig)
+	}
+
+	return nil
+}
+
+// addChecksum sets the checksum of fd, if checksums are on.
+func (v *Vault) addChecksum(vaultKey string, fd *filedata.FileData) {
+
+	fd.Checksum = ""
+
+	switch {
+	case v.integrityKey != nil:
+		fd.Checksum = checksumHMAC + ":" + v.checksum(checksumHMAC, vaultKey, fd)
+	case v.checksums:
+		fd.Checksum = checksumSHA256 + ":" + v.checksum(checksumSHA256, vaultKey, fd)
+	}
+}
+
+// verifyChecksum returns ErrCorrupt if fd has a checksum that doesn't
+// match, or ErrInvalidConfig for an HMAC without an integrity key.
+func (v *Vault) verifyChecksum(vaultKey string, fd *filedata.FileData) error {
+
+	if v.checksumStale(fd) && !v.uncheckedReads {
+		return fmt.Errorf("%w: value doesn't have the checksum the vault writes",
+			ErrCorrupt)
+	}
+
+	if fd.Checksum == "" {
+		return nil
+	}
+
+	kind, sum, _ := strings.Cut(fd.Checksum, ":")
+
+	switch kind {
+	case checksumSHA256:
+	case checksumHMAC:
+		if v.integrityKey == nil {
+			return fmt.Errorf("%w: no integrity key to verify the checksum",
+				ErrInvalidConfig)
+		}
+	default:
+		return fmt.Errorf("%w: unknown checksum %q", ErrCorrupt, kind)
+	}
+
+	expected, err := hex.DecodeString(sum)
+	if err != nil {
+		return fmt.Errorf("%w: checksum: %w", ErrCorrupt, err)
+	}
+
+	actual, _ := hex.DecodeString(v.checksum(kind, vaultKey, fd))
+
+	if !hmac.Equal(expected, actual) {
+		return fmt.Errorf("%w: checksum doesn't match", ErrCorrupt)
+	}
+
+	return nil
+}
+
+// checksumStale returns true if fd doesn't have the kind of checksum the
+// vault writes, or a stronger one.
+func (v *Vault) checksumStale(fd *filedata.FileData) bool {
+
+	switch {
+	case v.integrityKey != nil:
+		return !strings.HasPrefix(fd.Checksum, checksumHMAC+":")
+	case v.checksums:
+		return fd.Checksum == ""
+	}
+
+	return false
+}
+
+// checksum returns the hex checksum of kind over vaultKey and the fields
+// of fd, other than the checksum itself.
+func (v *Vault) checksum(kind string, vaultKey string, fd *filedata.FileData) string {
+
+	var h hash.Hash
+
+	if kind == checksumHMAC {
+		h = hmac.New(sha256.New, v.integrityKey.secret.Bytes())
+	} else {
+		h = sha256.New()
+	}
+
+	unsummed := *fd
+	unsummed.Checksum = ""
+
+	fdJSON, _ := json.Marshal(unsummed)
+
+	h.Write([]byte(canonicalKey(vaultKey)))
+	h.Write([]byte{0})
+	h.Write(fdJSON)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
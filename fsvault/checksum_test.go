@@ -0,0 +1,159 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thisdougb/go-fsvault/internal/filedata"
+)
+
+func TestChecksums(t *testing.T) {
+
+	var (
+		integrityKey = "eheheheheheheheheheheheheheheheh"
+		secretData   = "some not so secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	summed, _ := Open(testRootDir, WithEncryptionKeys(), WithChecksums(true))
+	keyed, _ := Open(testRootDir, WithEncryptionKeys(), WithIntegrityKey(integrityKey))
+	plain, _ := Open(testRootDir, WithEncryptionKeys())
+
+	summed.Put("/sha256", []byte(secretData))
+	keyed.Put("/hmac", []byte(secretData))
+	plain.Put("/none", []byte(secretData))
+
+	fd := readFileData(t, testRootDir, "/sha256")
+	assert.True(t, strings.HasPrefix(fd.Checksum, checksumSHA256+":"), "sha256 checksum")
+
+	fd = readFileData(t, testRootDir, "/hmac")
+	assert.True(t, strings.HasPrefix(fd.Checksum, checksumHMAC+":"), "hmac checksum")
+
+	// checksums are verified whatever the reader's own settings
+	for _, key := range []string{"/sha256", "/none"} {
+		data, err := plain.Get(key)
+		assert.Equal(t, nil, err, key)
+		assert.Equal(t, secretData, string(data), key)
+	}
+
+	_, err = plain.Get("/hmac")
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "hmac without a key")
+
+	data, err := keyed.Get("/hmac")
+	assert.Equal(t, nil, err, "hmac")
+	assert.Equal(t, secretData, string(data), "hmac")
+
+	// an edited value is caught
+	for _, key := range []string{"/sha256", "/hmac"} {
+		fd = readFileData(t, testRootDir, key)
+		fd.Data = []byte("some edited data")
+		writeFileData(t, testRootDir, key, fd)
+
+		_, err = keyed.Get(key)
+		assert.True(t, errors.Is(err, ErrCorrupt), key)
+	}
+
+	// a value moved to another key is caught
+	keyed.Put("/moved", []byte(secretData))
+	writeFileData(t, testRootDir, "/elsewhere", readFileData(t, testRootDir, "/moved"))
+
+	_, err = keyed.Get("/elsewhere")
+	assert.True(t, errors.Is(err, ErrCorrupt), "moved")
+
+	// an edited value with a new SHA-256 checksum is caught by the HMAC
+	fd = readFileData(t, testRootDir, "/moved")
+	fd.Data = []byte("some edited data")
+	summed.addChecksum("/moved", fd)
+	fd.Checksum = checksumHMAC + strings.TrimPrefix(fd.Checksum, checksumSHA256)
+	writeFileData(t, testRootDir, "/moved", fd)
+
+	_, err = keyed.Get("/moved")
+	assert.True(t, errors.Is(err, ErrCorrupt), "forged")
+
+	// a value replaced with one that has no checksum, or a SHA-256 checksum
+	// anyone can make, is caught
+	writeFileData(t, testRootDir, "/moved", &filedata.FileData{Data: []byte("evil")})
+	_, err = keyed.Get("/moved")
+	assert.True(t, errors.Is(err, ErrCorrupt), "checksum removed")
+
+	writeFileData(t, testRootDir, "/moved", readFileData(t, testRootDir, "/sha256"))
+	_, err = keyed.Get("/moved")
+	assert.True(t, errors.Is(err, ErrCorrupt), "checksum downgraded")
+
+	_, err = summed.Get("/none")
+	assert.True(t, errors.Is(err, ErrCorrupt), "no checksum")
+
+	// checksums work with encryption too
+	encrypted, _ := Open(testRootDir, WithEncryptionKeys(integrityKey), WithIntegrityKey(integrityKey))
+	encrypted.Put("/encrypted", []byte(secretData))
+
+	data, err = encrypted.Get("/encrypted")
+	assert.Equal(t, nil, err, "encrypted")
+	assert.Equal(t, secretData, string(data), "encrypted")
+
+	_, err = Open(testRootDir, WithIntegrityKey("short"))
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "invalid integrity key")
+}
+
+/*
+Test checksums are added to existing values by Rotate, with unchecked reads
+allowed while migrating.
+*/
+func TestChecksumsMigration(t *testing.T) {
+
+	var (
+		secretKey1   = "mylongsecdddddwwwwdtmylongsecret"
+		integrityKey = "eheheheheheheheheheheheheheheheh"
+		secretData   = "some not so secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	plain, _ := Open(testRootDir, WithEncryptionKeys())
+	plain.Put("/plain", []byte(secretData))
+
+	encrypted, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	encrypted.Put("/encrypted", []byte(secretData))
+
+	keyed, _ := Open(testRootDir, WithEncryptionKeys(secretKey1), WithIntegrityKey(integrityKey))
+	migrating, _ := Open(testRootDir, WithEncryptionKeys(secretKey1), WithIntegrityKey(integrityKey),
+		WithUncheckedReads(true))
+
+	for _, key := range []string{"/plain", "/encrypted"} {
+		_, err = keyed.Get(key)
+		assert.True(t, errors.Is(err, ErrCorrupt), "unchecked "+key)
+
+		data, err := migrating.Get(key)
+		assert.Equal(t, nil, err, "migrating "+key)
+		assert.Equal(t, secretData, string(data), "migrating "+key)
+	}
+
+	report, err := migrating.Rotate(RotateOptions{})
+	assert.Equal(t, nil, err, "rotate")
+	assert.Equal(t, 1, report.Rotated, "rotate")
+	assert.Equal(t, 1, report.Unencrypted, "rotate")
+
+	for _, key := range []string{"/plain", "/encrypted"} {
+		fd := readFileData(t, testRootDir, key)
+		assert.True(t, strings.HasPrefix(fd.Checksum, checksumHMAC+":"), "migrated "+key)
+		assert.Equal(t, uint64(1), fd.Revision, "migrated "+key)
+
+		data, err := keyed.Get(key)
+		assert.Equal(t, nil, err, "migrated "+key)
+		assert.Equal(t, secretData, string(data), "migrated "+key)
+	}
+}
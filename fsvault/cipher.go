@@ -0,0 +1,135 @@
+package fsvault
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/thisdougb/go-fsvault/internal/encryption"
+)
+
+// Cipher is an authenticated cipher used to encrypt data at rest. The
+// cipher name is stored with the data, so each value is decrypted with the
+// cipher that encrypted it, and data moves to a new cipher the same way it
+// moves to a new key.
+type Cipher interface {
+	// Name identifies the cipher in stored data, so must never change.
+	Name() string
+	// Seal encrypts and authenticates plaintext, and authenticates
+	// additionalData.
+	Seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error)
+	// Open reverses Seal, failing if the ciphertext or additionalData
+	// have changed.
+	Open(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error)
+}
+
+// Names of the built in ciphers.
+const (
+	CipherAESGCM           = "AES-GCM"
+	CipherChaCha20Poly1305 = "ChaCha20-Poly1305"
+)
+
+var (
+	ciphersLock sync.RWMutex
+	ciphers     = map[string]Cipher{
+		CipherAESGCM:           aesGCM{},
+		CipherChaCha20Poly1305: chaCha20Poly1305{},
+	}
+)
+
+// RegisterCipher makes c available by name, to WithCipher and to read data
+// it encrypted. Registering a name twice replaces the earlier cipher.
+func RegisterCipher(c Cipher) {
+
+	ciphersLock.Lock()
+	defer ciphersLock.Unlock()
+
+	ciphers[c.Name()] = c
+}
+
+// lookupCipher returns the registered cipher called name.
+func lookupCipher(name string) (Cipher, error) {
+
+	ciphersLock.RLock()
+	defer ciphersLock.RUnlock()
+
+	c, ok := ciphers[name]
+	if !ok {
+		return nil, fmt.Errorf("cipher %s is not registered", name)
+	}
+
+	return c, nil
+}
+
+// validateCipherKey returns ErrInvalidConfig if the primary (first) key of
+// keys can't be used with the cipher called name. Passphrase keys are
+// derived to 32 bytes, which every cipher takes.
+func validateCipherKey(name string, keys []encryptionKey) error {
+
+	if len(keys) == 0 || keys[0].secret == nil {
+		return nil
+	}
+
+	c, err := lookupCipher(name)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	if _, err := c.Seal(keys[0].secret.Bytes(), nil, nil); err != nil {
+		return fmt.Errorf("%w: the primary key can't be used with %s: %w",
+			ErrInvalidConfig, name, err)
+	}
+
+	return nil
+}
+
+// WithCipher sets the cipher used to encrypt data, by registered name. The
+// default is AES-GCM.
+func WithCipher(name string) Option {
+	return func(v *Vault) {
+		v.cipher = name
+	}
+}
+
+// aesGCM is AES-GCM, with AES-128, AES-192 or AES-256 chosen by key length.
+type aesGCM struct{}
+
+func (aesGCM) Name() string {
+	return CipherAESGCM
+}
+
+func (aesGCM) Seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	return encryption.EncryptWithAD(key, plaintext, additionalData)
+}
+
+func (aesGCM) Open(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	return encryption.DecryptWithAD(key, ciphertext, additionalData)
+}
+
+// chaCha20Poly1305 is fast without AES hardware support, and needs a 32
+// byte key.
+type chaCha20Poly1305 struct{}
+
+func (chaCha20Poly1305) Name() string {
+	return CipherChaCha20Poly1305
+}
+
+func (chaCha20Poly1305) Seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+
+	aead, err := encryption.NewChaCha20Poly1305(key)
+	if err != nil {
+		return nil, errors.New(err.Error())
+	}
+
+	return encryption.Seal(aead, plaintext, additionalData)
+}
+
+func (chaCha20Poly1305) Open(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+
+	aead, err := encryption.NewChaCha20Poly1305(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryption.Open(aead, ciphertext, additionalData)
+}
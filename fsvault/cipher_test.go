@@ -0,0 +1,167 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// xorCipher is a toy cipher, to test registration only.
+type xorCipher struct{}
+
+func (xorCipher) Name() string {
+	return "test-xor"
+}
+
+func (xorCipher) Seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+
+	out := make([]byte, len(plaintext))
+	for i := range plaintext {
+		out[i] = plaintext[i] ^ key[i%len(key)]
+	}
+	return out, nil
+}
+
+func (c xorCipher) Open(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	return c.Seal(key, ciphertext, additionalData)
+}
+
+// brokenCipher only seals empty plaintext, to test Put errors.
+type brokenCipher struct{ xorCipher }
+
+func (brokenCipher) Name() string {
+	return "test-broken"
+}
+
+func (brokenCipher) Seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+
+	if len(plaintext) > 0 {
+		return nil, errors.New("broken cipher")
+	}
+	return nil, nil
+}
+
+func TestCiphers(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretData = "some super secret data"
+	)
+
+	RegisterCipher(xorCipher{})
+
+	testCases := []struct {
+		description string
+		cipher      string
+		secretKey   string
+		expectError error
+	}{
+		{
+			description: "aes-gcm",
+			cipher:      CipherAESGCM,
+			secretKey:   secretKey1,
+			expectError: nil,
+		},
+		{
+			description: "chacha20-poly1305",
+			cipher:      CipherChaCha20Poly1305,
+			secretKey:   secretKey1,
+			expectError: nil,
+		},
+		{
+			description: "chacha20-poly1305 short key",
+			cipher:      CipherChaCha20Poly1305,
+			secretKey:   "eheheheheheheheh",
+			expectError: ErrInvalidConfig,
+		},
+		{
+			description: "registered cipher",
+			cipher:      "test-xor",
+			secretKey:   secretKey1,
+			expectError: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+
+		testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+		if err != nil {
+			assert.Fail(t, err.Error())
+		}
+		defer os.RemoveAll(testRootDir) // clean up
+
+		// the primary key is checked against the cipher when opened
+		v, err := Open(testRootDir, WithCipher(tc.cipher), WithEncryptionKeys(tc.secretKey))
+		if tc.expectError != nil {
+			assert.True(t, errors.Is(err, tc.expectError), tc.description)
+			continue
+		}
+		assert.Equal(t, nil, err, tc.description)
+
+		err = v.Put("/key", []byte(secretData))
+		assert.Equal(t, nil, err, tc.description)
+		assert.Equal(t, tc.cipher, readFileData(t, testRootDir, "/key").Cipher, tc.description)
+
+		data, err := v.Get("/key")
+		assert.Equal(t, nil, err, tc.description)
+		assert.Equal(t, secretData, string(data), tc.description)
+	}
+
+	_, err := Open("/tmp", WithCipher("no-such-cipher"))
+	assert.NotEqual(t, nil, err, "unregistered cipher")
+
+	// cipher errors name the key
+	RegisterCipher(brokenCipher{})
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v, err := Open(testRootDir, WithCipher("test-broken"), WithEncryptionKeys(secretKey1))
+	assert.Equal(t, nil, err, "broken cipher")
+
+	var keyErr *KeyError
+	err = v.Put("/key", []byte(secretData))
+	assert.True(t, errors.As(err, &keyErr), "broken cipher")
+	assert.Equal(t, "/key", keyErr.Key, "broken cipher")
+}
+
+/*
+Test data moves to a new cipher when read, like key rollover.
+*/
+func TestCipherRollover(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	aes, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	aes.Put("/key", []byte(secretData))
+
+	chacha, _ := Open(testRootDir, WithEncryptionKeys(secretKey1), WithCipher(CipherChaCha20Poly1305))
+	data, err := chacha.Get("/key")
+	assert.Equal(t, nil, err, "read aes-gcm data")
+	assert.Equal(t, secretData, string(data), "read aes-gcm data")
+	assert.Equal(t, CipherChaCha20Poly1305, readFileData(t, testRootDir, "/key").Cipher, "rolled cipher")
+
+	// an unknown cipher can't be decrypted
+	fd := readFileData(t, testRootDir, "/key")
+	fd.Cipher = "no-such-cipher"
+	writeFileData(t, testRootDir, "/key", fd)
+
+	_, err = chacha.Get("/key")
+	assert.True(t, errors.Is(err, ErrDecrypt), "unregistered cipher")
+}
@@ -0,0 +1,166 @@
+package fsvault
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/thisdougb/go-fsvault/internal/filedata"
+)
+
+// Each value is encrypted with its own random data key, which is stored with
+// the data wrapped (encrypted) by the primary encryption key. Rolling the
+// encryption key then only rewraps the small data key, and the payload is
+// left untouched.
+
+// dataKeySize is the length of a data key. Ciphers must accept 32 byte keys.
+const dataKeySize = 32
+
+// Rewrap re-encrypts the data key at key with the primary encryption key,
+// without re-encrypting the data. Data from before envelope encryption, or
+// encrypted with another cipher, is re-encrypted in full.
+func Rewrap(vaultRoot string, vaultKey string) error {
+	return vaultAt(vaultRoot).Rewrap(vaultKey)
+}
+
+// Rewrap re-encrypts the data key at key with the primary encryption key,
+// without re-encrypting the data. Data from before envelope encryption, or
+// encrypted with another cipher, is re-encrypted in full. Unencrypted data,
+// and data already using the primary key, is left as it is.
+//
+// Rewrap takes the key lock, so the caller must not already hold it.
+func (v *Vault) Rewrap(vaultKey string) error {
+
+	if err := v.checkSealed(); err != nil {
+		return keyError("rewrap", vaultKey, err)
+	}
+
+	if len(v.keyring(vaultKey)) == 0 {
+		return nil
+	}
+
+	_, err := v.rotateKey(vaultKey, false)
+	return err
+}
+
+// seal encrypts data into fd with a new data key, wrapped by the primary key.
+func (v *Vault) seal(vaultKey string, fd *filedata.FileData, data []byte) error {
+
+	c, err := lookupCipher(v.cipher)
+	if err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	defer clear(dataKey)
+
+	if _, err := rand.Read(dataKey); err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	// add the cipher name, so the data is decrypted with the same cipher
+	fd.Cipher = c.Name()
+	fd.Version = formatVersion
+
+	fd.Data, err = c.Seal(dataKey, data, additionalData(vaultKey, fd.Version))
+	if err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	if err := v.wrap(vaultKey, fd, c, dataKey); err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	return nil
+}
+
+// wrap encrypts dataKey into fd with the primary key.
+func (v *Vault) wrap(vaultKey string, fd *filedata.FileData, c Cipher, dataKey []byte) error {
+
+	if err := v.deriveWriteKeys(); err != nil {
+		return err
+	}
+
+	primary := v.keyring(vaultKey)[0]
+
+	wrappedKey, err := c.Seal(primary.secret.Bytes(), dataKey,
+		dataKeyAdditionalData(vaultKey, fd.Version))
+	if err != nil {
+		return err
+	}
+
+	fd.KeyID = primary.id
+	fd.DataKey = wrappedKey
+
+	return nil
+}
+
+// unwrap returns the data key in fd, and the position in the keyring of the
+// key that wrapped it.
+func (v *Vault) unwrap(vaultKey string, fd *filedata.FileData, c Cipher) ([]byte, int, error) {
+
+	keys := v.keyring(vaultKey)
+
+	i := keyIndex(keys, fd.KeyID)
+	if i < 0 {
+		return nil, -1, fmt.Errorf("%w: key id %s is not in the keyring",
+			ErrDecrypt, fd.KeyID)
+	}
+
+	dataKey, err := c.Open(keys[i].secret.Bytes(), fd.DataKey,
+		dataKeyAdditionalData(vaultKey, fd.Version))
+	if err != nil {
+		// the right key can't unwrap it, so the data has been changed
+		return nil, i, fmt.Errorf("%w: key id %s: %w", ErrCorrupt, fd.KeyID, err)
+	}
+
+	return dataKey, i, nil
+}
+
+// stale returns true if fd, decrypted with keyring position i, isn't using
+// the primary key, the vault cipher, or the latest format.
+func (v *Vault) stale(fd *filedata.FileData, i int) bool {
+	return i > 0 || fd.Cipher != v.cipher || fd.Version < formatVersion
+}
+
+// refresh re-stores fd, which decrypts to data, with the primary key, the
+// vault cipher and the latest format. When only the key is old the data key
+// is rewrapped and the data is left untouched. If the data has been written
+// since fd was read the newer data is left alone.
+func (v *Vault) refresh(vaultKey string, fd *filedata.FileData, data []byte) error {
+
+	err := v.rewrite(vaultKey, fd, data)
+	if errors.Is(err, ErrConflict) {
+		return nil
+	}
+
+	return err
+}
+
+// rewrite is refresh, but returns ErrConflict if the data has changed.
+func (v *Vault) rewrite(vaultKey string, fd *filedata.FileData, data []byte) error {
+
+	// the content hasn't changed, so neither does the revision
+	unchanged := sameRevision(fd.Revision)
+
+	if fd.DataKey == nil || fd.Cipher != v.cipher || fd.Version < formatVersion {
+		return v.put(vaultKey, data, unchanged)
+	}
+
+	c, err := lookupCipher(fd.Cipher)
+	if err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	dataKey, _, err := v.unwrap(vaultKey, fd, c)
+	if err != nil {
+		return keyError("put", vaultKey, err)
+	}
+	defer clear(dataKey)
+
+	if err := v.wrap(vaultKey, fd, c, dataKey); err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	return v.writeFileData(vaultKey, fd, unchanged)
+}
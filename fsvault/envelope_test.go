@@ -0,0 +1,129 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thisdougb/go-fsvault/internal/encryption"
+	"github.com/thisdougb/go-fsvault/internal/filedata"
+)
+
+/*
+Test each value gets its own data key, and rolling the encryption key only
+rewraps the data key, leaving the encrypted data untouched.
+*/
+func TestEnvelope(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretKey2 = "mylongsecdddddwwwwdtmylongsecret"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v1, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	v1.Put("/key1", []byte(secretData))
+	v1.Put("/key2", []byte(secretData))
+
+	fd1 := readFileData(t, testRootDir, "/key1")
+	fd2 := readFileData(t, testRootDir, "/key2")
+	assert.Equal(t, formatEnvelope, fd1.Version, "envelope version")
+	assert.NotEmpty(t, fd1.DataKey, "wrapped data key")
+	assert.NotEqual(t, fd1.DataKey, fd2.DataKey, "data key per value")
+
+	// reading with a new primary key rewraps the data key
+	v2, _ := Open(testRootDir, WithEncryptionKeys(secretKey2, secretKey1))
+	data, err := v2.Get("/key1")
+	assert.Equal(t, nil, err, "rollover read")
+	assert.Equal(t, secretData, string(data), "rollover read")
+
+	rolled := readFileData(t, testRootDir, "/key1")
+	assert.Equal(t, keyFingerprint([]byte(secretKey2)), rolled.KeyID, "rewrapped key id")
+	assert.NotEqual(t, fd1.DataKey, rolled.DataKey, "rewrapped data key")
+	assert.Equal(t, fd1.Data, rolled.Data, "data untouched")
+	assert.Equal(t, fd1.Revision, rolled.Revision, "revision untouched")
+
+	// the old key is no longer needed
+	v3, _ := Open(testRootDir, WithEncryptionKeys(secretKey2))
+	data, err = v3.Get("/key1")
+	assert.Equal(t, nil, err, "new key read")
+	assert.Equal(t, secretData, string(data), "new key read")
+
+	// a data key moved to another value fails to unwrap
+	fd2.DataKey = rolled.DataKey
+	fd2.KeyID = rolled.KeyID
+	writeFileData(t, testRootDir, "/key2", fd2)
+	_, err = v3.Get("/key2")
+	assert.True(t, errors.Is(err, ErrCorrupt), "swapped data key")
+}
+
+func TestRewrap(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretKey2 = "mylongsecdddddwwwwdtmylongsecret"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v1, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	v1.Put("/enveloped", []byte(secretData))
+
+	// data encrypted directly with the key, before envelope encryption
+	cipherData, _ := encryption.EncryptWithAD([]byte(secretKey1), []byte(secretData),
+		additionalData("/direct", formatBound))
+	writeFileData(t, testRootDir, "/direct", &filedata.FileData{
+		Data:    cipherData,
+		Cipher:  CipherAESGCM,
+		KeyID:   keyFingerprint([]byte(secretKey1)),
+		Version: formatBound,
+	})
+
+	unencrypted, _ := Open(testRootDir)
+	unencrypted.Put("/plain", []byte(secretData))
+
+	v2, _ := Open(testRootDir, WithEncryptionKeys(secretKey2, secretKey1))
+
+	before := readFileData(t, testRootDir, "/enveloped")
+	assert.Equal(t, nil, v2.Rewrap("/enveloped"), "rewrap")
+	after := readFileData(t, testRootDir, "/enveloped")
+	assert.Equal(t, keyFingerprint([]byte(secretKey2)), after.KeyID, "rewrapped key id")
+	assert.Equal(t, before.Data, after.Data, "data untouched")
+
+	// already using the primary key, so nothing changes
+	assert.Equal(t, nil, v2.Rewrap("/enveloped"), "rewrap current")
+	assert.Equal(t, after, readFileData(t, testRootDir, "/enveloped"), "rewrap current")
+
+	assert.Equal(t, nil, v2.Rewrap("/direct"), "rewrap direct")
+	after = readFileData(t, testRootDir, "/direct")
+	assert.Equal(t, formatEnvelope, after.Version, "direct data re-encrypted")
+	assert.Equal(t, keyFingerprint([]byte(secretKey2)), after.KeyID, "direct data re-encrypted")
+
+	assert.Equal(t, nil, v2.Rewrap("/plain"), "rewrap unencrypted")
+	assert.Equal(t, "", readFileData(t, testRootDir, "/plain").Cipher, "unencrypted untouched")
+
+	err = v2.Rewrap("/missing")
+	assert.True(t, errors.Is(err, ErrNotFound), "rewrap missing key")
+
+	// everything reads with only the new key
+	v3, _ := Open(testRootDir, WithEncryptionKeys(secretKey2))
+	for _, key := range []string{"/enveloped", "/direct", "/plain"} {
+		data, err := v3.Get(key)
+		assert.Equal(t, nil, err, key)
+		assert.Equal(t, secretData, string(data), key)
+	}
+}
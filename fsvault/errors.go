@@ -0,0 +1,87 @@
+package fsvault
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Errors returned by vault operations, wrapped in a *KeyError. Test for them
+// with errors.Is().
+var (
+	ErrNotFound   = errors.New("key does not exist")
+	ErrNotEmpty   = errors.New("key is not empty")
+	ErrPermission = errors.New("key has unusable permissions")
+	ErrDecrypt    = errors.New("data could not be decrypted")
+	ErrCorrupt    = errors.New("data is corrupt")
+	ErrInvalidKey = errors.New("invalid vault key")
+	ErrConflict   = errors.New("key has changed")
+
+	ErrInvalidConfig      = errors.New("invalid encryption configuration")
+	ErrEncryptionRequired = errors.New("encryption is required")
+	ErrSealed             = errors.New("vault is sealed")
+	ErrInvalidShare       = errors.New("invalid unseal share")
+	ErrClosed             = errors.New("vault is closed")
+)
+
+// KeyError records the vault key and operation that caused an error.
+type KeyError struct {
+	Op  string // operation, e.g. "get" or "put"
+	Key string // vault key
+	Err error  // wraps one of the Err* errors, and any underlying error
+}
+
+func (e *KeyError) Error() string {
+	return "fsvault: " + e.Op + " " + e.Key + ": " + e.Err.Error()
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// keyError returns err as a *KeyError, wrapping the matching Err* error
+// so callers don't need to inspect platform specific error strings.
+func keyError(op string, vaultKey string, err error) error {
+
+	var sentinel error
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		sentinel = ErrNotFound
+	case errors.Is(err, fs.ErrPermission):
+		sentinel = ErrPermission
+	case errors.Is(err, syscall.ENOTEMPTY):
+		sentinel = ErrNotEmpty
+	}
+
+	if sentinel != nil && !errors.Is(err, sentinel) {
+		err = fmt.Errorf("%w: %w", sentinel, err)
+	}
+
+	return &KeyError{Op: op, Key: vaultKey, Err: err}
+}
+
+// validateKey returns ErrInvalidKey if vaultKey could resolve to a path
+// outside of the vault root, or to the vault's own files, such as the
+// metadata and seal, which only the vault itself may change.
+func validateKey(vaultKey string) error {
+
+	if strings.ContainsRune(vaultKey, 0) {
+		return ErrInvalidKey
+	}
+
+	isSeparator := func(r rune) bool {
+		return r == '/' || r == filepath.Separator
+	}
+
+	for _, segment := range strings.FieldsFunc(vaultKey, isSeparator) {
+		if segment == ".." || isInternalName(segment) {
+			return ErrInvalidKey
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSentinelErrors(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v, err := Open(testRootDir, WithEncryptionKeys("eheheheheheheheheheheheheheheheh"))
+	assert.Equal(t, nil, err, "open")
+
+	v.Put("/sub/key1", []byte("some data"))
+	v.Put("/key2", []byte("some data"))
+	os.WriteFile(filepath.Join(testRootDir, "corrupt"), []byte("{not json"), 0644)
+
+	other, err := Open(testRootDir, WithEncryptionKeys("mylongsecdddddwwwwdtmylongsecret"))
+	assert.Equal(t, nil, err, "open other")
+
+	testCases := []struct {
+		description string
+		op          func() error
+		expectError error
+	}{
+		{
+			description: "get missing key",
+			op: func() error {
+				_, err := v.Get("/no-such-key")
+				return err
+			},
+			expectError: ErrNotFound,
+		},
+		{
+			description: "delete missing key",
+			op:          func() error { return v.Delete("/no-such-key") },
+			expectError: ErrNotFound,
+		},
+		{
+			description: "delete populated key",
+			op:          func() error { return v.Delete("/sub") },
+			expectError: ErrNotEmpty,
+		},
+		{
+			description: "get with wrong key",
+			op: func() error {
+				_, err := other.Get("/key2")
+				return err
+			},
+			expectError: ErrDecrypt,
+		},
+		{
+			description: "get corrupt data",
+			op: func() error {
+				_, err := v.Get("/corrupt")
+				return err
+			},
+			expectError: ErrCorrupt,
+		},
+		{
+			description: "put outside the vault root",
+			op:          func() error { return v.Put("/../escaped", []byte("some data")) },
+			expectError: ErrInvalidKey,
+		},
+		{
+			description: "put vault metadata",
+			op:          func() error { return v.Put("/.fsvault-meta", []byte("some data")) },
+			expectError: ErrInvalidKey,
+		},
+		{
+			description: "delete vault seal",
+			op:          func() error { return v.Delete(".fsvault-seal") },
+			expectError: ErrInvalidKey,
+		},
+		{
+			description: "get temp file",
+			op: func() error {
+				_, err := v.Get("/sub/.fsvault-tmp-1234")
+				return err
+			},
+			expectError: ErrInvalidKey,
+		},
+	}
+
+	for _, tc := range testCases {
+
+		err := tc.op()
+		assert.True(t, errors.Is(err, tc.expectError), tc.description)
+
+		var keyErr *KeyError
+		assert.True(t, errors.As(err, &keyErr), tc.description)
+	}
+
+	// the underlying os error is still available
+	_, err = v.Get("/no-such-key")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "fs.ErrNotExist")
+}
@@ -0,0 +1,212 @@
+package fsvault
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LockMode selects how key locks are shared.
+type LockMode int
+
+const (
+	// LockInProcess locks keys between goroutines in this process only.
+	LockInProcess LockMode = iota
+	// LockFile also takes an flock on a lock file per key, so processes
+	// sharing the vault root, including fsvcli, are serialised too.
+	LockFile
+)
+
+// lockDirName is the directory under the vault root holding lock files,
+// one per key locked or written. Lock files are named by a hash of the key's
+// path, so they can't clash with each other and don't show key names.
+//
+// Lock files are never removed, as removing them races with new lockers,
+// and the revision lock file holds the key's last revision. The directory
+// can be removed while no process has the vault open, which lets the
+// revisions of deleted keys start again at 1.
+const lockDirName = internalPrefix + "locks"
+
+// internalLock is an in-process lock id for the vault's own locks, a type
+// of its own so it can't be mistaken for a key lock.
+type internalLock string
+
+// Lock file extensions, for the key lock and the revision lock.
+const (
+	keyLockExt      = ".lock"
+	revisionLockExt = ".rev"
+)
+
+// lockPollInterval is how often a held lock file is retried while waiting
+// on a context, as flock can't be interrupted.
+var lockPollInterval = 10 * time.Millisecond
+
+// WithLockMode sets how key locks are shared, see LockMode.
+func WithLockMode(mode LockMode) Option {
+	return func(v *Vault) {
+		v.lockMode = mode
+	}
+}
+
+// fileLock holds the in-process lock and the lock file for a key, both
+// exclusive or both shared.
+type fileLock struct {
+	inProcess Unlocker
+	file      *os.File
+}
+
+// Unlock releases the lock file, then the in-process lock.
+func (l *fileLock) Unlock() {
+
+	// closing the file releases the flock even if the unlock fails
+	funlock(l.file)
+	l.file.Close()
+
+	l.inProcess.Unlock()
+}
+
+// openLockFile opens, creating if needed, the lock file for vaultKey with
+// extension ext.
+func (v *Vault) openLockFile(vaultKey string, ext string) (*os.File, error) {
+
+	lockPath, err := v.keyLockPath(vaultKey, ext)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.openLockPath(lockPath)
+}
+
+// keyLockPath returns the path of the lock file for vaultKey with
+// extension ext.
+func (v *Vault) keyLockPath(vaultKey string, ext string) (string, error) {
+
+	if err := validateKey(vaultKey); err != nil {
+		return "", err
+	}
+
+	// hash the path on disk, so encrypted names are locked by their
+	// encrypted name like any other
+	relative, err := v.diskPath(vaultKey)
+	if err != nil {
+		return "", err
+	}
+
+	return v.lockPath(relative, ext), nil
+}
+
+// lockPath returns the path of the lock file for the path relative to the
+// vault root, with extension ext.
+func (v *Vault) lockPath(relative string, ext string) string {
+
+	sum := sha256.Sum256([]byte(filepath.ToSlash(filepath.Clean("/" + relative))))
+
+	return filepath.Join(v.root, lockDirName, hex.EncodeToString(sum[:])+ext)
+}
+
+// openLockPath opens, creating if needed, the lock file at lockPath.
+func (v *Vault) openLockPath(lockPath string) (*os.File, error) {
+
+	if err := os.MkdirAll(filepath.Dir(lockPath), v.dirPerm); err != nil {
+		return nil, err
+	}
+
+	// flock doesn't need write access, so read-only works for any user who
+	// can read the vault
+	return os.OpenFile(lockPath, os.O_RDONLY|os.O_CREATE, v.filePerm)
+}
+
+// lockExclusive takes the in-process lock id and the flock on the lock file
+// f, opened with err, whatever the LockMode. Platforms without file locks
+// fall back to the in-process lock. vaultKey names the lock in errors.
+func (v *Vault) lockExclusive(vaultKey string, id any, f *os.File, err error) (Unlocker, error) {
+
+	lock := v.locker.lock(id)
+
+	if err == nil {
+		if err = flock(f, false, false); err != nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		if errors.Is(err, errors.ErrUnsupported) {
+			return lock, nil
+		}
+		lock.Unlock()
+		return nil, keyError("lock", vaultKey, err)
+	}
+
+	return &fileLock{inProcess: lock, file: f}, nil
+}
+
+// lockKeyFile takes the exclusive key lock and lock file for vaultKey,
+// whatever the LockMode. Platforms without file locks fall back to the
+// in-process lock.
+func (v *Vault) lockKeyFile(vaultKey string) (Unlocker, error) {
+
+	f, err := v.openLockFile(vaultKey, keyLockExt)
+
+	return v.lockExclusive(vaultKey, vaultKey, f, err)
+}
+
+// lockFileContext takes the flock for vaultKey, polling while it is held
+// until ctx is done.
+func (v *Vault) lockFileContext(ctx context.Context, vaultKey string, shared bool) (*os.File, error) {
+
+	f, err := v.openLockFile(vaultKey, keyLockExt)
+	if err != nil {
+		return nil, err
+	}
+
+	// without a deadline we can simply block in the kernel
+	if ctx.Done() == nil {
+		if err = flock(f, shared, false); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+
+	for {
+		err = flock(f, shared, true)
+		if err == nil {
+			return f, nil
+		}
+
+		if !errors.Is(err, errWouldBlock) {
+			f.Close()
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// tryLockFile takes the flock for vaultKey only if it is free.
+func (v *Vault) tryLockFile(vaultKey string, shared bool) (*os.File, bool, error) {
+
+	f, err := v.openLockFile(vaultKey, keyLockExt)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = flock(f, shared, true)
+	if err != nil {
+		f.Close()
+		if errors.Is(err, errWouldBlock) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	return f, true, nil
+}
@@ -0,0 +1,243 @@
+//go:build dev && (darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package fsvault
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+Test file locks are shared between vaults that don't share in-process locks,
+as separate processes would.
+*/
+func TestFileLocks(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	vault1, err := Open(testRootDir, WithLockMode(LockFile))
+	assert.Equal(t, nil, err, "open vault1")
+
+	vault2, err := Open(testRootDir, WithLockMode(LockFile))
+	assert.Equal(t, nil, err, "open vault2")
+
+	vault1.Put("/user/23/map", []byte("{}"))
+
+	held, _, err := vault1.GetWithLock("/user/23/map")
+	assert.Equal(t, nil, err, "vault1 lock")
+
+	_, ok := vault2.TryLockKey("/user/23/map")
+	assert.False(t, ok, "vault2 try held lock")
+
+	_, err = vault2.LockKeyTimeout("/user/23/map", 30*time.Millisecond)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "vault2 timed out lock")
+
+	// other keys are unaffected
+	lock, ok := vault2.TryLockKey("/user/24/map")
+	assert.True(t, ok, "vault2 other key")
+	lock.Unlock()
+
+	held.Unlock()
+
+	lock, ok = vault2.TryLockKey("/user/23/map")
+	assert.True(t, ok, "vault2 released lock")
+	lock.Unlock()
+
+	// lock files don't show up as keys
+	assert.Equal(t, []string{"/user/"}, vault1.List("/"), "list")
+}
+
+/*
+Test map updates through file locked vaults don't lose writes.
+*/
+func TestFileLocksMapUpdates(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	done := make(chan bool)
+
+	for i := 0; i < 4; i++ {
+
+		v, err := Open(testRootDir, WithLockMode(LockFile))
+		assert.Equal(t, nil, err, "open")
+
+		go func(v *Vault) {
+			m := MapOf[int](v)
+			for j := 0; j < 25; j++ {
+				lock, count, _ := m.GetValueWithLock("/counter", "count")
+				m.PutValue("/counter", "count", count+1)
+				lock.Unlock()
+			}
+			done <- true
+		}(v)
+	}
+
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	assert.Equal(t, 100, GetMapValue[int](testRootDir, "/counter", "count"), "count")
+}
+
+func TestFileRLocks(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	vault1, err := Open(testRootDir, WithLockMode(LockFile))
+	assert.Equal(t, nil, err, "open vault1")
+
+	vault2, err := Open(testRootDir, WithLockMode(LockFile))
+	assert.Equal(t, nil, err, "open vault2")
+
+	reader1 := vault1.RLockKey("/config")
+
+	reader2, ok := vault2.TryRLockKey("/config")
+	assert.True(t, ok, "vault2 shared lock")
+
+	other, ok := vault2.TryLockKey("/other")
+	assert.True(t, ok, "vault2 other key")
+	other.Unlock()
+
+	reader2.Unlock()
+
+	_, ok = vault2.TryLockKey("/config")
+	assert.False(t, ok, "vault2 exclusive lock with vault1 reader")
+
+	reader1.Unlock()
+
+	writer, ok := vault2.TryLockKey("/config")
+	assert.True(t, ok, "vault2 exclusive lock")
+	writer.Unlock()
+}
+
+/*
+Test the package level functions use lock files with FSVAULT_LOCK_FILES.
+*/
+func TestPackageFileLocks(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	// restore the package level config
+	defer func() {
+		os.Unsetenv("FSVAULT_LOCK_FILES")
+		Configure()
+	}()
+
+	os.Setenv("FSVAULT_LOCK_FILES", "true")
+	assert.Equal(t, nil, Configure(), "configure")
+
+	other, err := Open(testRootDir, WithLockMode(LockFile))
+	assert.Equal(t, nil, err, "open")
+
+	lock, count := GetMapValueWithLock[int](testRootDir, "/counter", "count")
+
+	_, ok := other.TryLockKey("/counter")
+	assert.False(t, ok, "held by package level lock")
+
+	PutMapValue(testRootDir, "/counter", "count", count+1)
+	lock.Unlock()
+
+	held, ok := other.TryLockKey("/counter")
+	assert.True(t, ok, "released")
+	held.Unlock()
+
+	// a lock file that can't be taken still holds the in-process lock
+	os.RemoveAll(testRootDir + "/" + lockDirName)
+	err = os.WriteFile(testRootDir+"/"+lockDirName, []byte{}, 0600)
+	assert.Equal(t, nil, err, "block lock directory")
+
+	lock, _ = GetMapValueWithLock[int](testRootDir, "/counter", "count")
+
+	_, ok = keylocker.tryLock("/counter")
+	assert.False(t, ok, "held in-process")
+
+	lock.Unlock()
+
+	held, ok = keylocker.tryLock("/counter")
+	assert.True(t, ok, "released in-process")
+	held.Unlock()
+}
+
+/*
+Test lock files don't clash with the data of keys named like them.
+*/
+func TestLockFileNames(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v, err := Open(testRootDir, WithLockMode(LockFile))
+	assert.Equal(t, nil, err, "open")
+
+	for _, key := range []string{"/x", "/x.rev/y", "/x.lock/y"} {
+		assert.Equal(t, nil, v.Put(key, []byte("data")), key)
+
+		lock, _, err := v.GetWithLock(key)
+		assert.Equal(t, nil, err, key)
+		lock.Unlock()
+	}
+
+	// lock files are in one directory
+	entries, _ := os.ReadDir(filepath.Join(testRootDir, lockDirName))
+	for _, entry := range entries {
+		assert.False(t, entry.IsDir(), entry.Name())
+	}
+}
+
+/*
+Test a lock file that can't be taken is an error, not a silent fallback to
+the in-process lock.
+*/
+func TestFileLockErrors(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v, err := Open(testRootDir, WithLockMode(LockFile))
+	assert.Equal(t, nil, err, "open")
+
+	// a file in place of the lock directory
+	err = os.WriteFile(testRootDir+"/"+lockDirName, []byte{}, 0600)
+	assert.Equal(t, nil, err, "block lock directory")
+
+	lock, _, err := v.GetWithLock("/config")
+	assert.NotEqual(t, nil, err, "get with lock")
+	lock.Unlock()
+
+	lock, _, err = MapOf[int](v).GetValueWithLock("/config", "count")
+	assert.NotEqual(t, nil, err, "map get with lock")
+	lock.Unlock()
+
+	// nothing is left held
+	held, ok := v.locker.tryLock("/config")
+	assert.True(t, ok, "in-process lock released")
+	held.Unlock()
+}
@@ -0,0 +1,21 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+)
+
+// errWouldBlock is returned by a non-blocking flock on a held lock.
+var errWouldBlock = errors.New("lock is held")
+
+// flock is not supported on this platform, so LockFile can't be used.
+func flock(f *os.File, shared bool, nonBlocking bool) error {
+	return errors.ErrUnsupported
+}
+
+// funlock is not supported on this platform.
+func funlock(f *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,36 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package fsvault
+
+import (
+	"os"
+	"syscall"
+)
+
+// errWouldBlock is returned by a non-blocking flock on a held lock.
+var errWouldBlock = syscall.EWOULDBLOCK
+
+// flock takes an exclusive, or shared, lock on f, failing with
+// errWouldBlock if the lock is held and nonBlocking is set.
+func flock(f *os.File, shared bool, nonBlocking bool) error {
+
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if nonBlocking {
+		how |= syscall.LOCK_NB
+	}
+
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// funlock releases the lock on f.
+func funlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -162,8 +162,9 @@ func TestInvalidKeyLength(t *testing.T) {
 
 		encryptionKeys = tc.secretKeys // package var
 
+		// the cipher error is wrapped in a KeyError
 		err = Put(testRootDir, tc.vaultKey, []byte(tc.data))
-		assert.Equal(t, tc.expectError, err, tc.description)
+		assert.Equal(t, tc.expectError, errors.Unwrap(err), tc.description)
 	}
 }
 
@@ -1,45 +1,220 @@
 package fsvault
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/thisdougb/go-fsvault/internal/config"
 )
 
 // package level vars
 var (
-	encryptionKeys []string
-	keylocker      *keyLocker
+	encryptionKeys    []string
+	requireEncryption bool
+	encryptNames      bool
+	checksums         bool
+	integrityKey      string
+	uncheckedReads    bool
+	rotateOnRead      RotateOnRead
+	lockMode          LockMode
+	keylocker         *keyLocker
+
+	// configErr is why the environment config is invalid, which package
+	// level operations return rather than carrying on without encryption
+	configErr error
+
+	// settingsErr is why the config other than the keys is invalid, kept
+	// so configErr can be worked out again for new keys, see LoadKeys
+	settingsErr error
+
+	// configMu guards the package level config, which Configure and
+	// LoadKeys can change while package level calls are reading it
+	configMu sync.RWMutex
 )
 
 func init() {
 
 	keylocker = newkeyLocker()
 
-	// try to load encryption keys from env vars
-	encryptionKeys = getEncryptionKeysFromEnv()
-	if len(encryptionKeys) > 0 {
+	err := Configure()
+
+	switch {
+	case err != nil:
+		log.Println("fsvault.init():", err)
+	case len(encryptionKeys) > 0:
 		log.Println("fsvault.init(): encryption enabled.")
-	} else {
+	default:
 		log.Println("fsvault.init(): encryption not enabled.")
 	}
 }
 
-func getEncryptionKeysFromEnv() []string {
+// Configure loads the package level configuration from the environment
+// variables FSVAULT_SECRET_KEYS (or FSVAULT_SECRET_KEYS_FILE, or
+// FSVAULT_SECRET_KEYS_COMMAND), FSVAULT_CIPHER, FSVAULT_REQUIRE_ENCRYPTION,
+// FSVAULT_ENCRYPT_NAMES, FSVAULT_CHECKSUMS, FSVAULT_INTEGRITY_KEY,
+// FSVAULT_UNCHECKED_READS, FSVAULT_ROTATE_ON_READ and FSVAULT_LOCK_FILES.
+// It runs at init, but call it to get the error
+// for an invalid configuration, which wraps ErrInvalidConfig or
+// ErrEncryptionRequired.
+//
+// While the configuration is invalid, package level operations that write
+// data, or read encrypted data, return the error.
+func Configure() error {
+
+	keys, keysErr := getEncryptionKeysFromEnv()
+	c, cipherErr := getCipherFromEnv()
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	encryptionKeys = keys
+	cipher = c
+	integrityKey = config.StringValue("FSVAULT_INTEGRITY_KEY")
+
+	var requireErr, namesErr, checksumsErr, uncheckedErr error
+	requireEncryption, requireErr = boolSetting("FSVAULT_REQUIRE_ENCRYPTION")
+	encryptNames, namesErr = boolSetting("FSVAULT_ENCRYPT_NAMES")
+	checksums, checksumsErr = boolSetting("FSVAULT_CHECKSUMS")
+	uncheckedReads, uncheckedErr = boolSetting("FSVAULT_UNCHECKED_READS")
+
+	// fail closed, so vaults from Open don't write unencrypted data either
+	if requireErr != nil {
+		requireEncryption = true
+	}
+
+	lockFiles, lockErr := boolSetting("FSVAULT_LOCK_FILES")
+
+	lockMode = LockInProcess
+	if lockFiles {
+		lockMode = LockFile
+	}
+
+	integrityErr := validateIntegrityKey(sharedIntegrityKey(integrityKey))
+	if integrityErr != nil {
+		integrityErr = fmt.Errorf("FSVAULT_INTEGRITY_KEY: %w", integrityErr)
+	}
+
+	var rotateErr error
+	rotateOnRead, rotateErr = parseRotateOnRead(config.StringValue("FSVAULT_ROTATE_ON_READ"))
+	if rotateErr != nil {
+		rotateErr = fmt.Errorf("FSVAULT_ROTATE_ON_READ: %w", rotateErr)
+	}
+
+	settingsErr = errors.Join(cipherErr, requireErr, namesErr, checksumsErr,
+		integrityErr, uncheckedErr, rotateErr, lockErr)
+	configErr = keysConfigError(keysErr)
+
+	dropUnusedKeys()
+
+	return configErr
+}
+
+// keysConfigError returns why the package level config is invalid, given
+// keysErr from loading the keys, checking the keys against the settings.
+// The caller must hold configMu.
+func keysConfigError(keysErr error) error {
 
-	keys := []string{}
+	var cipherKeyErr error
+	if keysErr == nil {
+		cipherKeyErr = validateCipherKey(cipher, sharedKeys(encryptionKeys))
+	}
 
-	keysEnvVar := config.StringValue("FSVAULT_SECRET_KEYS")
+	err := errors.Join(keysErr, cipherKeyErr, settingsErr)
+	if err == nil && requireEncryption && len(encryptionKeys) == 0 {
+		err = fmt.Errorf("%w: no encryption keys", ErrEncryptionRequired)
+	}
+	if err == nil && encryptNames && len(encryptionKeys) == 0 {
+		err = fmt.Errorf("%w: FSVAULT_ENCRYPT_NAMES needs encryption keys",
+			ErrEncryptionRequired)
+	}
 
-	for _, k := range strings.Split(keysEnvVar, ",") {
+	return err
+}
+
+// boolSetting returns the environment variable key as a bool, or its default
+// if it isn't set or is empty. A value that isn't a bool is ErrInvalidConfig,
+// rather than quietly becoming the default.
+func boolSetting(key string) (bool, error) {
+
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return config.BoolValue(key), nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return config.BoolValue(key), fmt.Errorf("%w: %s: %q is not true or false",
+			ErrInvalidConfig, key, value)
+	}
+
+	return b, nil
+}
+
+func getCipherFromEnv() (string, error) {
+
+	name := config.StringValue("FSVAULT_CIPHER")
+
+	if _, err := lookupCipher(name); err != nil {
+		return CipherAESGCM, fmt.Errorf("%w: FSVAULT_CIPHER: %w", ErrInvalidConfig, err)
+	}
+
+	return name, nil
+}
+
+// getEncryptionKeysFromEnv returns the keys from FSVAULT_SECRET_KEYS, or
+// the key file or command named by FSVAULT_SECRET_KEYS_FILE or
+// FSVAULT_SECRET_KEYS_COMMAND. Only one of them may be set.
+func getEncryptionKeysFromEnv() ([]string, error) {
+
+	var (
+		keysEnvVar  = config.StringValue("FSVAULT_SECRET_KEYS")
+		keysFile    = config.StringValue("FSVAULT_SECRET_KEYS_FILE")
+		keysCommand = strings.Fields(config.StringValue("FSVAULT_SECRET_KEYS_COMMAND"))
+		source      = "FSVAULT_SECRET_KEYS"
+		provider    KeyProvider
+		keys        []string
+		err         error
+		sources     int
+	)
+
+	if strings.TrimSpace(keysEnvVar) != "" {
+		sources++
+	}
+
+	if keysFile != "" {
+		sources++
+		source = "FSVAULT_SECRET_KEYS_FILE"
+		provider = KeyFile(keysFile)
+	}
+
+	if len(keysCommand) > 0 {
+		sources++
+		source = "FSVAULT_SECRET_KEYS_COMMAND"
+		provider = KeyCommand(keysCommand[0], keysCommand[1:]...)
+	}
+
+	if sources > 1 {
+		return []string{}, fmt.Errorf("%w: only one of FSVAULT_SECRET_KEYS, FSVAULT_SECRET_KEYS_FILE or FSVAULT_SECRET_KEYS_COMMAND can be set",
+			ErrInvalidConfig)
+	}
+
+	// keys may be labelled as "label:secret", and encoded or derived from a
+	// passphrase, see parseKey()
+	if provider == nil {
+		keys = splitKeys(keysEnvVar)
+	} else if keys, err = provider.Keys(context.Background()); err != nil {
+		return []string{}, fmt.Errorf("%w: %s: %w", ErrInvalidConfig, source, err)
+	}
 
-		if len(k) == 16 || len(k) == 24 || len(k) == 32 {
-			keys = append(keys, strings.TrimSpace(k))
-		} else {
-			log.Println("fsvault.init(): invalid secret key length, ignoring", k)
-		}
+	if err := validateKeys(sharedKeys(keys)); err != nil {
+		return keys, fmt.Errorf("%s: %w", source, err)
 	}
 
-	return keys
+	return keys, nil
 }
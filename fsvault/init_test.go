@@ -0,0 +1,197 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thisdougb/go-fsvault/internal/encryption"
+	"github.com/thisdougb/go-fsvault/internal/filedata"
+)
+
+func TestConfigure(t *testing.T) {
+
+	testCases := []struct {
+		description string
+		secretKeys  string
+		cipher      string
+		require     string
+		expectKeys  []string
+		expectError error
+	}{
+		{
+			description: "no keys",
+			secretKeys:  "",
+			expectKeys:  []string{},
+		},
+		{
+			description: "empty keys",
+			secretKeys:  " , ",
+			expectKeys:  []string{},
+		},
+		{
+			description: "valid keys",
+			secretKeys:  "key2:mylongsecdddddwwwwdtmylongsecret, eheheheheheheheheheheheheheheheh",
+			expectKeys:  []string{"key2:mylongsecdddddwwwwdtmylongsecret", "eheheheheheheheheheheheheheheheh"},
+		},
+		{
+			description: "invalid key",
+			secretKeys:  "eheheheheheheheheheheheheheheheh,tooshort",
+			expectKeys:  []string{"eheheheheheheheheheheheheheheheh", "tooshort"},
+			expectError: ErrInvalidConfig,
+		},
+		{
+			description: "invalid cipher",
+			secretKeys:  "eheheheheheheheheheheheheheheheh",
+			cipher:      "ROT13",
+			expectKeys:  []string{"eheheheheheheheheheheheheheheheh"},
+			expectError: ErrInvalidConfig,
+		},
+		{
+			description: "cipher with a short key",
+			secretKeys:  "eheheheheheheheh",
+			cipher:      "ChaCha20-Poly1305",
+			expectKeys:  []string{"eheheheheheheheh"},
+			expectError: ErrInvalidConfig,
+		},
+		{
+			description: "encryption required",
+			secretKeys:  "eheheheheheheheheheheheheheheheh",
+			require:     "true",
+			expectKeys:  []string{"eheheheheheheheheheheheheheheheh"},
+		},
+		{
+			description: "encryption required without keys",
+			secretKeys:  "",
+			require:     "true",
+			expectKeys:  []string{},
+			expectError: ErrEncryptionRequired,
+		},
+		{
+			description: "encryption required is not a bool",
+			secretKeys:  "",
+			require:     "yes",
+			expectKeys:  []string{},
+			expectError: ErrInvalidConfig,
+		},
+	}
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	// restore the package level config
+	defer func() {
+		os.Unsetenv("FSVAULT_SECRET_KEYS")
+		os.Unsetenv("FSVAULT_CIPHER")
+		os.Unsetenv("FSVAULT_REQUIRE_ENCRYPTION")
+		Configure()
+	}()
+
+	for _, tc := range testCases {
+
+		os.Setenv("FSVAULT_SECRET_KEYS", tc.secretKeys)
+		os.Unsetenv("FSVAULT_CIPHER")
+		if tc.cipher != "" {
+			os.Setenv("FSVAULT_CIPHER", tc.cipher)
+		}
+		os.Setenv("FSVAULT_REQUIRE_ENCRYPTION", tc.require)
+
+		err := Configure()
+		assert.Equal(t, tc.expectKeys, encryptionKeys, tc.description)
+
+		if tc.expectError == nil {
+			assert.Equal(t, nil, err, tc.description)
+			assert.Equal(t, nil, Put(testRootDir, "/key", []byte("data")), tc.description)
+			continue
+		}
+
+		assert.True(t, errors.Is(err, tc.expectError), tc.description)
+		assert.False(t, strings.Contains(err.Error(), "tooshort"), "key not in error")
+
+		// package level writes fail, rather than writing unencrypted data
+		err = Put(testRootDir, "/key", []byte("data"))
+		assert.True(t, errors.Is(err, tc.expectError), tc.description)
+	}
+}
+
+/*
+Test a setting that isn't a bool is an error, rather than quietly off.
+*/
+func TestConfigureBoolSettings(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	settings := []string{
+		"FSVAULT_REQUIRE_ENCRYPTION",
+		"FSVAULT_ENCRYPT_NAMES",
+		"FSVAULT_CHECKSUMS",
+		"FSVAULT_UNCHECKED_READS",
+		"FSVAULT_LOCK_FILES",
+	}
+
+	// restore the package level config
+	defer Configure()
+
+	for _, setting := range settings {
+
+		os.Setenv(setting, "yes")
+		err := Configure()
+		os.Unsetenv(setting)
+
+		assert.True(t, errors.Is(err, ErrInvalidConfig), setting)
+		assert.True(t, strings.Contains(err.Error(), setting), setting)
+	}
+
+	// an unknown value for required encryption fails closed
+	os.Setenv("FSVAULT_REQUIRE_ENCRYPTION", "yes")
+	defer os.Unsetenv("FSVAULT_REQUIRE_ENCRYPTION")
+	Configure()
+
+	_, err = Open(testRootDir, WithEncryptionKeys())
+	assert.True(t, errors.Is(err, ErrEncryptionRequired), "open without keys")
+}
+
+func TestRequireEncryption(t *testing.T) {
+
+	secretKey1 := "eheheheheheheheheheheheheheheheh"
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	_, err = Open(testRootDir, WithEncryptionKeys(), WithRequireEncryption(true))
+	assert.True(t, errors.Is(err, ErrEncryptionRequired), "open without keys")
+
+	_, err = Open(testRootDir, WithEncryptionKeys(secretKey1, "tooshort"))
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "open with invalid key")
+
+	v, err := Open(testRootDir, WithEncryptionKeys(secretKey1), WithRequireEncryption(true))
+	assert.Equal(t, nil, err, "open with keys")
+	assert.Equal(t, nil, v.Put("/key", []byte("data")), "encrypted put")
+
+	// a vault without keys won't return the encrypted data
+	plain, _ := Open(testRootDir, WithEncryptionKeys())
+	_, err = plain.Get("/key")
+	assert.True(t, errors.Is(err, ErrDecrypt), "get without keys")
+
+	cipherData, _ := encryption.Encrypt([]byte(secretKey1), []byte("data"))
+	writeFileData(t, testRootDir, "/legacy", &filedata.FileData{
+		Data:   cipherData,
+		Cipher: CipherAESGCM,
+	})
+	_, err = plain.Get("/legacy")
+	assert.True(t, errors.Is(err, ErrDecrypt), "get legacy without keys")
+}
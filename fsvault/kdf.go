@@ -0,0 +1,228 @@
+package fsvault
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/thisdougb/go-fsvault/internal/securemem"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Passphrase keys are stretched into secret keys with scrypt. Each vault
+// has its own random salt, kept with the KDF parameters in a metadata file
+// at the vault root, so the same passphrase gives different keys in
+// different vaults. The metadata file is created when a vault with a
+// passphrase key is first written, and must be kept with the data.
+//
+// Until then passphrase keys aren't derived, as nothing can have been
+// encrypted with them, so reads don't create a salt for a vault root that
+// is mistyped or not yet mounted.
+
+// Default scrypt parameters for new vaults, see scrypt.Key().
+const (
+	kdfScrypt      = "scrypt"
+	kdfSaltSize    = 16
+	kdfScryptN     = 32768
+	kdfScryptR     = 8
+	kdfScryptP     = 1
+	derivedKeySize = 32
+)
+
+// kdfParams are the KDF and parameters used to derive passphrase keys.
+type kdfParams struct {
+	Name string `json:"name"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+// derivedKeys caches derived secrets, so vaults opened for each package
+// level call don't run the KDF every time. Keyed by a hash of the KDF
+// parameters and passphrase. A vault from Open derives its own secrets, so
+// Close can wipe them.
+var (
+	derivedKeys   = map[[sha256.Size]byte]derivedKey{}
+	derivedKeysMu sync.Mutex
+)
+
+// derivedKey is a cached derived secret, with a hash of its passphrase so
+// it can be dropped once the passphrase is no longer configured.
+type derivedKey struct {
+	secret     *securemem.Buffer
+	passphrase [sha256.Size]byte
+}
+
+// deriveKeys replaces the passphrase keys in each keyring with secrets
+// derived using the vault metadata. If the vault has no KDF parameters yet
+// they are added when create is set, otherwise the keys are left as they
+// are. Keyrings are replaced rather than changed, so a keyring already
+// returned by keyring() doesn't change under the caller.
+func (v *Vault) deriveKeys(create bool) error {
+
+	v.keysMu.Lock()
+	defer v.keysMu.Unlock()
+
+	var params *kdfParams
+
+	keyrings := [][]encryptionKey{slices.Clone(v.keys)}
+	for _, p := range v.prefixKeys {
+		keyrings = append(keyrings, slices.Clone(p.keys))
+	}
+
+	for _, keys := range keyrings {
+		for i, k := range keys {
+
+			if k.passphrase == "" {
+				continue
+			}
+
+			if params == nil {
+				var err error
+				if params, err = v.kdf(create); err != nil || params == nil {
+					return err
+				}
+			}
+
+			secret, err := deriveKey(*params, k.passphrase, v.shared)
+			if err != nil {
+				return err
+			}
+
+			if k.id == "" {
+				k.id = keyFingerprint(secret.Bytes())
+			}
+			k.secret = secret
+			k.passphrase = ""
+
+			keys[i] = k
+		}
+	}
+
+	prefixKeys := slices.Clone(v.prefixKeys)
+	for i := range prefixKeys {
+		prefixKeys[i].keys = keyrings[i+1]
+	}
+
+	v.keys, v.prefixKeys = keyrings[0], prefixKeys
+
+	return nil
+}
+
+// deriveWriteKeys derives the passphrase keys deriveKeys left, adding the
+// KDF parameters to the vault metadata, before data is encrypted.
+func (v *Vault) deriveWriteKeys() error {
+
+	if !v.passphrasePending() {
+		return nil
+	}
+
+	return v.deriveKeys(true)
+}
+
+// passphrasePending returns true if any passphrase key isn't derived yet.
+func (v *Vault) passphrasePending() bool {
+
+	for _, keyring := range v.keyrings() {
+		for _, k := range keyring.keys {
+			if k.passphrase != "" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// kdf returns the KDF parameters from the vault metadata. If the vault
+// doesn't have any, they are added with a new random salt when create is
+// set, otherwise kdf returns nil.
+func (v *Vault) kdf(create bool) (*kdfParams, error) {
+
+	if !create {
+		meta, err := readMetadata(filepath.Join(v.root, metadataName))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return meta.KDF, nil
+	}
+
+	meta, err := v.updateMetadata(func(meta *vaultMetadata) (bool, error) {
+
+		if meta.KDF != nil {
+			return false, nil
+		}
+
+		params := &kdfParams{
+			Name: kdfScrypt,
+			Salt: make([]byte, kdfSaltSize),
+			N:    kdfScryptN,
+			R:    kdfScryptR,
+			P:    kdfScryptP,
+		}
+
+		if _, err := rand.Read(params.Salt); err != nil {
+			return false, err
+		}
+
+		meta.KDF = params
+
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return meta.KDF, nil
+}
+
+// deriveKey returns the secret derived from passphrase with params, from
+// the cache if cached is set.
+func deriveKey(params kdfParams, passphrase string, cached bool) (*securemem.Buffer, error) {
+
+	if params.Name != kdfScrypt {
+		return nil, fmt.Errorf("unknown kdf %q", params.Name)
+	}
+
+	if !cached {
+		secret, err := scrypt.Key([]byte(passphrase), params.Salt,
+			params.N, params.R, params.P, derivedKeySize)
+		if err != nil {
+			return nil, err
+		}
+
+		return securemem.Move(secret), nil
+	}
+
+	paramsJSON, _ := json.Marshal(params)
+	cacheKey := sha256.Sum256(append(paramsJSON, passphrase...))
+
+	derivedKeysMu.Lock()
+	defer derivedKeysMu.Unlock()
+
+	if derived, ok := derivedKeys[cacheKey]; ok {
+		return derived.secret, nil
+	}
+
+	secret, err := deriveKey(params, passphrase, false)
+	if err != nil {
+		return nil, err
+	}
+
+	derivedKeys[cacheKey] = derivedKey{
+		secret:     secret,
+		passphrase: sha256.Sum256([]byte(passphrase)),
+	}
+
+	return secret, nil
+}
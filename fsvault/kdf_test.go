@@ -0,0 +1,150 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+Test passphrase keys are derived with a salt kept in the vault metadata, so
+the same passphrase reads the vault back but gives a different key in
+another vault.
+*/
+func TestPassphraseKeys(t *testing.T) {
+
+	var (
+		passphrase = "passphrase:correct horse battery staple"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	otherRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(otherRootDir) // clean up
+
+	v1, err := Open(testRootDir, WithEncryptionKeys(passphrase))
+	assert.Equal(t, nil, err, "open")
+	assert.Equal(t, nil, v1.Put("/key", []byte(secretData)), "put")
+
+	meta, err := readMetadata(filepath.Join(testRootDir, metadataName))
+	assert.Equal(t, nil, err, "metadata created")
+	assert.Len(t, meta.KDF.Salt, kdfSaltSize, "metadata salt")
+	assert.Equal(t, []string{"/key"}, v1.List("/"), "metadata not listed")
+
+	// the salt can't be removed, or replaced, through the vault
+	assert.True(t, errors.Is(v1.Delete("/"+metadataName), ErrInvalidKey), "delete metadata")
+	assert.True(t, errors.Is(v1.Put("/"+metadataName, []byte("{}")), ErrInvalidKey), "put metadata")
+
+	fd := readFileData(t, testRootDir, "/key")
+	assert.Equal(t, v1.keys[0].id, fd.KeyID, "derived key id")
+	assert.NotEqual(t, []byte(secretData), fd.Data, "data encrypted")
+
+	// the same passphrase, in another process, uses the same salt
+	v2, _ := Open(testRootDir, WithEncryptionKeys(passphrase))
+	data, err := v2.Get("/key")
+	assert.Equal(t, nil, err, "reopened read")
+	assert.Equal(t, secretData, string(data), "reopened read")
+
+	// package level calls derive the same key
+	encryptionKeys = []string{passphrase} // package var
+	data, err = Get(testRootDir, "/key")
+	encryptionKeys = []string{}
+	assert.Equal(t, nil, err, "package level read")
+	assert.Equal(t, secretData, string(data), "package level read")
+
+	other, _ := Open(otherRootDir, WithEncryptionKeys(passphrase))
+	other.Put("/key", []byte(secretData))
+	assert.NotEqual(t, v1.keys[0].secret.Bytes(), other.keys[0].secret.Bytes(), "salt per vault")
+
+	// labelled passphrase keys keep their label
+	labelled, _ := Open(testRootDir, WithEncryptionKeys("key1:"+passphrase))
+	assert.Equal(t, "key1", labelled.keys[0].id, "labelled passphrase")
+	assert.Equal(t, v1.keys[0].secret.Bytes(), labelled.keys[0].secret.Bytes(), "labelled passphrase")
+}
+
+/*
+Test reads don't create the vault metadata, so a mistyped vault root doesn't
+silently get a new salt.
+*/
+func TestPassphraseKeysReadOnly(t *testing.T) {
+
+	var (
+		passphrase = "passphrase:correct horse battery staple"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	missingRoot := filepath.Join(testRootDir, "missing")
+
+	encryptionKeys = []string{passphrase} // package var
+	defer func() { encryptionKeys = []string{} }()
+
+	assert.Equal(t, []string{}, List(missingRoot, "/"), "package level list")
+	_, err = Get(missingRoot, "/key")
+	assert.True(t, errors.Is(err, ErrNotFound), "package level get")
+
+	v, err := Open(missingRoot, WithEncryptionKeys(passphrase), WithEncryptedNames(true))
+	assert.Equal(t, nil, err, "open")
+	assert.Equal(t, []string{}, v.List("/"), "list encrypted names")
+	_, err = v.Get("/key")
+	assert.True(t, errors.Is(err, ErrNotFound), "get encrypted names")
+
+	_, err = os.Stat(missingRoot)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "root not created")
+
+	// the first write adds the salt
+	assert.Equal(t, nil, v.Put("/key", []byte(secretData)), "put")
+
+	meta, err := readMetadata(filepath.Join(missingRoot, metadataName))
+	assert.Equal(t, nil, err, "metadata created")
+	assert.Len(t, meta.KDF.Salt, kdfSaltSize, "metadata salt")
+
+	_, err = Get(missingRoot, "/key")
+	assert.True(t, errors.Is(err, ErrNotFound), "names are encrypted")
+
+	reopened, _ := Open(missingRoot, WithEncryptionKeys(passphrase), WithEncryptedNames(true))
+	data, err := reopened.Get("/key")
+	assert.Equal(t, nil, err, "reopened read")
+	assert.Equal(t, secretData, string(data), "reopened read")
+}
+
+/*
+Test a vault with corrupt metadata can't be opened with a passphrase key.
+*/
+func TestPassphraseKeysCorruptMetadata(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	os.WriteFile(filepath.Join(testRootDir, metadataName), []byte("{"), 0600)
+
+	_, err = Open(testRootDir, WithEncryptionKeys("passphrase:correct horse battery staple"))
+	assert.True(t, errors.Is(err, ErrCorrupt), "corrupt metadata")
+
+	// package level calls refuse to write unencrypted data instead
+	encryptionKeys = []string{"passphrase:correct horse battery staple"} // package var
+	err = Put(testRootDir, "/key", []byte("some super secret data"))
+	encryptionKeys = []string{}
+	assert.True(t, errors.Is(err, ErrCorrupt), "package level put")
+}
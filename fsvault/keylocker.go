@@ -6,22 +6,39 @@ package fsvault
 // For example, you can acquire a lock for a specific user ID and all other requests for that user ID
 // will block until that entry is unlocked (effectively your work load will be run serially per-user ID),
 // and yet have work for separate user IDs happen concurrently.
+//
+// Locks are exclusive, or shared between readers. Waiting writers block new
+// readers, so a busy read key can't starve writers.
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 )
 
+// errLockHeld is returned when a try lock finds the lock held.
+var errLockHeld = errors.New("lock is held")
+
 type keyLocker struct {
 	keymapLock sync.Mutex                   // synchronisation around the keymap
 	keymap     map[interface{}]*keymapEntry // keymap holds the individual key locks
 }
 
 type keymapEntry struct {
-	keymap    *keyLocker  // point back to keyLocker, so we can synchronize removing this mentry when cnt==0
-	entryLock sync.Mutex  // entry-specific lock
-	cnt       int         // reference count
-	key       interface{} // key in keymap, may be string, int, etc.
+	keymap  *keyLocker    // point back to keyLocker, so we can synchronize removing this mentry when cnt==0
+	cnt     int           // reference count
+	key     interface{}   // key in keymap, may be string, int, etc.
+	state   sync.Mutex    // synchronisation around the lock state below
+	writer  bool          // held exclusively
+	readers int           // number of shared holders
+	waiting int           // writers waiting, which block new readers
+	changed chan struct{} // closed, and replaced, whenever the lock state changes
+}
+
+// readLock is a shared hold on an entry.
+type readLock struct {
+	entry *keymapEntry
 }
 
 // Unlocker provides an Unlock method to release the lock.
@@ -39,43 +56,178 @@ func newkeyLocker() *keyLocker {
 // to release the lock when done.
 func (kl *keyLocker) lock(key interface{}) Unlocker {
 
-	// read or create entry for this key atomically
+	// a background context never ends, so this can't fail
+	lock, _ := kl.acquire(context.Background(), key, false, true)
+	return lock
+}
+
+// rlock acquires a shared lock corresponding to this key, held alongside
+// other readers. Unlock() must be called to release the lock when done.
+func (kl *keyLocker) rlock(key interface{}) Unlocker {
+
+	lock, _ := kl.acquire(context.Background(), key, true, true)
+	return lock
+}
+
+// lockContext acquires a lock corresponding to this key, or returns
+// ctx.Err() if ctx is done before the lock is acquired. On success
+// Unlock() must be called to release the lock when done.
+func (kl *keyLocker) lockContext(ctx context.Context, key interface{}) (Unlocker, error) {
+	return kl.acquire(ctx, key, false, true)
+}
+
+// rlockContext is lockContext for a shared lock.
+func (kl *keyLocker) rlockContext(ctx context.Context, key interface{}) (Unlocker, error) {
+	return kl.acquire(ctx, key, true, true)
+}
+
+// tryLock acquires the lock corresponding to this key only if it is free,
+// returning ok=false without waiting if it is held.
+func (kl *keyLocker) tryLock(key interface{}) (Unlocker, bool) {
+
+	lock, err := kl.acquire(context.Background(), key, false, false)
+	return lock, err == nil
+}
+
+// tryRLock acquires a shared lock corresponding to this key only if it
+// isn't held, or waited on, by a writer.
+func (kl *keyLocker) tryRLock(key interface{}) (Unlocker, bool) {
+
+	lock, err := kl.acquire(context.Background(), key, true, false)
+	return lock, err == nil
+}
+
+// acquire takes the lock for key, shared or exclusive. If wait is false it
+// returns errLockHeld rather than waiting, otherwise it waits until the
+// lock is acquired or ctx is done.
+func (kl *keyLocker) acquire(ctx context.Context, key interface{}, shared bool, wait bool) (Unlocker, error) {
+
+	// don't race a free lock against a done context
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	entry := kl.reference(key)
+
+	entry.state.Lock()
+	if !shared {
+		entry.waiting++
+	}
+
+	for {
+		if shared && !entry.writer && entry.waiting == 0 {
+			entry.readers++
+			entry.state.Unlock()
+			return &readLock{entry: entry}, nil
+		}
+
+		if !shared && !entry.writer && entry.readers == 0 {
+			entry.waiting--
+			entry.writer = true
+			entry.state.Unlock()
+			return entry, nil
+		}
+
+		var err error
+		changed := entry.changed
+
+		if !wait {
+			err = errLockHeld
+		} else {
+			entry.state.Unlock()
+
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+
+			entry.state.Lock()
+		}
+
+		if err != nil {
+			if !shared {
+				// readers held back by this writer can go ahead
+				entry.waiting--
+				entry.notify()
+			}
+			entry.state.Unlock()
+
+			kl.dereference(entry)
+			return nil, err
+		}
+	}
+}
+
+// notify wakes everything waiting on the entry. The caller must hold the
+// entry state lock.
+func (entry *keymapEntry) notify() {
+	close(entry.changed)
+	entry.changed = make(chan struct{})
+}
+
+// reference reads or creates the entry for this key atomically, and counts
+// the caller as a user of it.
+func (kl *keyLocker) reference(key interface{}) *keymapEntry {
+
 	kl.keymapLock.Lock()
+	defer kl.keymapLock.Unlock()
+
 	entry, ok := kl.keymap[key]
 	if !ok {
-		entry = &keymapEntry{keymap: kl, key: key}
+		entry = &keymapEntry{
+			keymap:  kl,
+			key:     key,
+			changed: make(chan struct{}),
+		}
 		kl.keymap[key] = entry
 	}
 	entry.cnt++ // ref count
-	kl.keymapLock.Unlock()
-
-	// acquire lock, will block here until e.cnt==1
-	entry.entryLock.Lock()
 
 	return entry
 }
 
-// Unlock releases the lock for this entry.
-func (entry *keymapEntry) Unlock() {
-
-	kl := entry.keymap
+// dereference decrements the entry reference count, and removes the entry
+// from the keymap when it is no longer used.
+func (kl *keyLocker) dereference(entry *keymapEntry) {
 
-	// lock the keyLocker map
 	kl.keymapLock.Lock()
+	defer kl.keymapLock.Unlock()
 
-	// decrement and if needed remove entry atomically
 	e, ok := kl.keymap[entry.key]
 	if !ok { // entry must exist
-		kl.keymapLock.Unlock()
 		panic(fmt.Errorf("Unlock requested for key=%v but no entry found", entry.key))
 	}
 	e.cnt--        // ref count
 	if e.cnt < 1 { // if it hits zero then we own it and remove from map
 		delete(kl.keymap, entry.key)
 	}
-	kl.keymapLock.Unlock()
+}
+
+// Unlock releases the lock for this entry.
+func (entry *keymapEntry) Unlock() {
+
+	// let anything else waiting on this key through
+	entry.state.Lock()
+	entry.writer = false
+	entry.notify()
+	entry.state.Unlock()
+
+	// decrement and if needed remove entry atomically
+	entry.keymap.dereference(entry)
+}
+
+// Unlock releases this reader's share of the lock.
+func (l *readLock) Unlock() {
+
+	entry := l.entry
+
+	entry.state.Lock()
+	entry.readers--
+	if entry.readers == 0 {
+		entry.notify()
+	}
+	entry.state.Unlock()
 
-	// now that map stuff is handled, we unlock and let
-	// anything else waiting on this key through
-	entry.entryLock.Unlock()
+	entry.keymap.dereference(entry)
 }
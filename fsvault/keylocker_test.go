@@ -0,0 +1,195 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockContext(t *testing.T) {
+
+	kl := newkeyLocker()
+
+	held := kl.lock("key1")
+
+	// a held lock times out
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	lock, err := kl.lockContext(ctx, "key1")
+	assert.Equal(t, nil, lock, "timed out lock")
+	assert.Equal(t, context.DeadlineExceeded, err, "timed out lock")
+
+	// a cancelled context never acquires the lock, even a free one
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+
+	_, err = kl.lockContext(cancelled, "key2")
+	assert.Equal(t, context.Canceled, err, "cancelled lock")
+
+	// once released the lock can be acquired
+	held.Unlock()
+
+	lock, err = kl.lockContext(context.Background(), "key1")
+	assert.Equal(t, nil, err, "released lock")
+	lock.Unlock()
+
+	// abandoned waits don't leak keymap entries
+	assert.Equal(t, 0, len(kl.keymap), "keymap entries")
+}
+
+func TestGetWithLockContext(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v, err := Open(testRootDir)
+	assert.Equal(t, nil, err, "open")
+
+	v.Put("/key1", []byte("some data"))
+
+	held, data, err := v.GetWithLockContext(context.Background(), "/key1")
+	assert.Equal(t, nil, err, "first lock")
+	assert.Equal(t, "some data", string(data), "first lock")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	lock, _, err := v.GetWithLockContext(ctx, "/key1")
+	assert.Equal(t, nil, lock, "second lock")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "second lock")
+
+	_, _, err = MapOf[TestValue](v).GetValueWithLockContext(ctx, "/key1", "mapKey")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "map value lock")
+
+	held.Unlock()
+}
+
+func TestTryLock(t *testing.T) {
+
+	kl := newkeyLocker()
+
+	lock, ok := kl.tryLock("key1")
+	assert.True(t, ok, "free lock")
+
+	_, ok = kl.tryLock("key1")
+	assert.False(t, ok, "held lock")
+
+	_, ok = kl.tryLock("key2")
+	assert.True(t, ok, "other key")
+
+	lock.Unlock()
+
+	lock, ok = kl.tryLock("key1")
+	assert.True(t, ok, "released lock")
+	lock.Unlock()
+}
+
+func TestLockKeyTimeout(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	held := LockKey(testRootDir, "/job/user/23")
+
+	_, ok := TryLockKey(testRootDir, "/job/user/23")
+	assert.False(t, ok, "try held lock")
+
+	start := time.Now()
+	lock, err := LockKeyTimeout(testRootDir, "/job/user/23", 20*time.Millisecond)
+	assert.Equal(t, nil, lock, "timed out lock")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "timed out lock")
+	assert.True(t, time.Since(start) >= 20*time.Millisecond, "waited for timeout")
+
+	// release from another goroutine while we wait
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		held.Unlock()
+	}()
+
+	lock, err = LockKeyTimeout(testRootDir, "/job/user/23", time.Second)
+	assert.Equal(t, nil, err, "lock released while waiting")
+	lock.Unlock()
+}
+
+func TestRLock(t *testing.T) {
+
+	kl := newkeyLocker()
+
+	// readers share the lock
+	reader1 := kl.rlock("key1")
+	reader2, ok := kl.tryRLock("key1")
+	assert.True(t, ok, "second reader")
+
+	_, ok = kl.tryLock("key1")
+	assert.False(t, ok, "writer with readers")
+
+	// a waiting writer holds back new readers
+	writerDone := make(chan Unlocker)
+	go func() {
+		writerDone <- kl.lock("key1")
+	}()
+
+	assert.Eventually(t, func() bool {
+		lock, ok := kl.tryRLock("key1")
+		if ok {
+			lock.Unlock()
+		}
+		return !ok
+	}, time.Second, time.Millisecond, "reader with waiting writer")
+
+	reader1.Unlock()
+	reader2.Unlock()
+
+	writer := <-writerDone
+
+	_, ok = kl.tryRLock("key1")
+	assert.False(t, ok, "reader with writer")
+
+	writer.Unlock()
+
+	reader, ok := kl.tryRLock("key1")
+	assert.True(t, ok, "reader after writer")
+	reader.Unlock()
+
+	assert.Equal(t, 0, len(kl.keymap), "keymap entries")
+}
+
+func TestGetWithRLock(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	PutMapValue(testRootDir, "/config", "key1", TestValue{"value1"})
+
+	lock1, data := GetMapWithRLock[TestValue](testRootDir, "/config")
+	assert.Equal(t, 1, len(data), "first reader")
+
+	lock2, value := GetMapValueWithRLock[TestValue](testRootDir, "/config", "key1")
+	assert.Equal(t, "value1", value.Id, "second reader")
+
+	_, ok := TryLockKey(testRootDir, "/config")
+	assert.False(t, ok, "writer with readers")
+
+	lock1.Unlock()
+	lock2.Unlock()
+
+	lock, ok := TryLockKey(testRootDir, "/config")
+	assert.True(t, ok, "writer after readers")
+	lock.Unlock()
+}
@@ -0,0 +1,210 @@
+package fsvault
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/thisdougb/go-fsvault/internal/securemem"
+)
+
+// encryptionKey is a secret key, and the id stored with the data it
+// encrypts so Get can go straight to the right key.
+type encryptionKey struct {
+	id         string
+	secret     *securemem.Buffer // nil until a passphrase is derived
+	passphrase string            // set until the secret is derived, see deriveKeys()
+	ambiguous  bool              // reads as both a raw and a labelled key
+}
+
+// keyIDPrefix is hashed with the secret, so key ids aren't a plain hash of
+// the key that could be looked up.
+const keyIDPrefix = "fsvault key id:"
+
+// Key string prefixes for secrets that aren't given as raw bytes.
+const (
+	keyPrefixBase64     = "base64:"
+	keyPrefixHex        = "hex:"
+	keyPrefixPassphrase = "passphrase:"
+)
+
+// validKeyLength returns true for the AES-128, AES-192 and AES-256 key sizes.
+func validKeyLength(secret []byte) bool {
+	return len(secret) == 16 || len(secret) == 24 || len(secret) == 32
+}
+
+// valid returns true if k can be used to encrypt data.
+func (k encryptionKey) valid() bool {
+	return !k.ambiguous && (k.passphrase != "" || validKeyLength(k.secret.Bytes()))
+}
+
+// parseKey splits an optional label from a key string. A key may be given
+// as "label:secret", where the label becomes the key id, otherwise the id
+// is a fingerprint of the secret. See parseSecret for the secret formats.
+//
+// A raw key containing a colon can also read as "label:secret". Which was
+// meant can't be told, and picking one could lose the data encrypted with
+// the other, so the key is ambiguous and fails validateKeys. Such a key must
+// be labelled, or encoded, to be read as a whole.
+func parseKey(key string) encryptionKey {
+
+	label, secret, found := strings.Cut(key, ":")
+	if found && label != "" && !isSecretPrefix(label+":") {
+		if k, ok := parseSecret(secret); ok {
+			if validKeyLength([]byte(key)) {
+				k.secret.Wipe()
+				return encryptionKey{ambiguous: true}
+			}
+			k.id = label
+			return k
+		}
+	}
+
+	if k, ok := parseSecret(key); ok {
+		return k
+	}
+
+	raw := []byte(key)
+
+	return encryptionKey{id: keyFingerprint(raw), secret: securemem.Move(raw)}
+}
+
+// isSecretPrefix returns true if prefix marks an encoded secret, rather
+// than a label.
+func isSecretPrefix(prefix string) bool {
+	return prefix == keyPrefixBase64 || prefix == keyPrefixHex || prefix == keyPrefixPassphrase
+}
+
+// parseSecret parses a secret given as "base64:" or "hex:" encoded bytes, a
+// "passphrase:" to derive the secret from, or raw bytes of a valid key
+// length. A passphrase key has no id until the secret is derived.
+func parseSecret(secret string) (encryptionKey, bool) {
+
+	var (
+		decoded []byte
+		err     error
+	)
+
+	switch {
+	case strings.HasPrefix(secret, keyPrefixPassphrase):
+		passphrase := strings.TrimPrefix(secret, keyPrefixPassphrase)
+		return encryptionKey{passphrase: passphrase}, passphrase != ""
+
+	case strings.HasPrefix(secret, keyPrefixBase64):
+		decoded, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, keyPrefixBase64))
+
+	case strings.HasPrefix(secret, keyPrefixHex):
+		decoded, err = hex.DecodeString(strings.TrimPrefix(secret, keyPrefixHex))
+
+	default:
+		decoded = []byte(secret)
+	}
+
+	if err != nil || !validKeyLength(decoded) {
+		clear(decoded)
+		return encryptionKey{}, false
+	}
+
+	return encryptionKey{id: keyFingerprint(decoded), secret: securemem.Move(decoded)}, true
+}
+
+// validateKeys returns ErrInvalidConfig if any key can't be used, or two
+// keys have the same id. The error gives the position of the key, not the
+// key itself.
+func validateKeys(keys []encryptionKey) error {
+
+	var errs []error
+
+	for i, k := range keys {
+		if k.ambiguous {
+			errs = append(errs, fmt.Errorf("%w: key %d of %d could be raw or labelled, label or encode it",
+				ErrInvalidConfig, i+1, len(keys)))
+			continue
+		}
+
+		if !k.valid() {
+			errs = append(errs, fmt.Errorf("%w: key %d of %d is not a valid key",
+				ErrInvalidConfig, i+1, len(keys)))
+			continue
+		}
+
+		// passphrase keys get their id when derived
+		if j := keyIndex(keys[:i], k.id); k.id != "" && j >= 0 {
+			errs = append(errs, fmt.Errorf("%w: key %d of %d has the same id as key %d",
+				ErrInvalidConfig, i+1, len(keys), j+1))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// parseKeys parses a list of key strings, see parseKey.
+func parseKeys(keys []string) []encryptionKey {
+
+	parsed := make([]encryptionKey, 0, len(keys))
+
+	for _, k := range keys {
+		parsed = append(parsed, parseKey(k))
+	}
+
+	return parsed
+}
+
+// keyFingerprint returns a short id for secret.
+func keyFingerprint(secret []byte) string {
+
+	h := sha256.New()
+	h.Write([]byte(keyIDPrefix))
+	h.Write(secret)
+
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// keyIndex returns the position of the key with id in keys, or -1.
+func keyIndex(keys []encryptionKey, id string) int {
+
+	for i, k := range keys {
+		if k.id == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// FileData formats. Version 0 data isn't bound to its vault key, version 1
+// authenticates the vault key and version as additional data, and version 2
+// encrypts the data with its own data key, wrapped by the encryption key.
+const (
+	formatBound    = 1
+	formatEnvelope = 2
+
+	// formatVersion is the format written by Put
+	formatVersion = formatEnvelope
+)
+
+// additionalData returns the data authenticated alongside the ciphertext,
+// so a file moved or copied to another vault key fails to decrypt. Version
+// 0 data has none.
+func additionalData(vaultKey string, version int) []byte {
+
+	if version < 1 {
+		return nil
+	}
+
+	// the same key can be written in different ways, e.g. "a" and "/a/"
+	canonicalKey := path.Clean("/" + filepath.ToSlash(vaultKey))
+
+	return []byte(fmt.Sprintf("fsvault:v%d:%s", version, canonicalKey))
+}
+
+// dataKeyAdditionalData returns the data authenticated alongside a wrapped
+// data key, which differs from the data's so the two can't be swapped.
+func dataKeyAdditionalData(vaultKey string, version int) []byte {
+	return append(additionalData(vaultKey, version), ":datakey"...)
+}
@@ -0,0 +1,276 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thisdougb/go-fsvault/internal/encryption"
+	"github.com/thisdougb/go-fsvault/internal/filedata"
+)
+
+func TestParseKey(t *testing.T) {
+
+	testCases := []struct {
+		description  string
+		key          string
+		expectID     string
+		expectSecret string
+	}{
+		{
+			description:  "unlabelled key",
+			key:          "eheheheheheheheheheheheheheheheh",
+			expectID:     keyFingerprint([]byte("eheheheheheheheheheheheheheheheh")),
+			expectSecret: "eheheheheheheheheheheheheheheheh",
+		},
+		{
+			description:  "labelled key",
+			key:          "key2:eheheheheheheheheheheheheheheheh",
+			expectID:     "key2",
+			expectSecret: "eheheheheheheheheheheheheheheheh",
+		},
+		{
+			description:  "labelled 16 byte key",
+			key:          "primary1:0123456789abcdef",
+			expectID:     "primary1",
+			expectSecret: "0123456789abcdef",
+		},
+		{
+			description:  "raw key that also reads as a labelled key",
+			key:          "abcdefg:0123456789abcdef01234567",
+			expectID:     "",
+			expectSecret: "",
+		},
+		{
+			description:  "unlabelled 32 byte key containing a colon",
+			key:          "eheheheheheheh:eheheheheheheheeh",
+			expectID:     keyFingerprint([]byte("eheheheheheheh:eheheheheheheheeh")),
+			expectSecret: "eheheheheheheh:eheheheheheheheeh",
+		},
+		{
+			description:  "unlabelled key containing a colon",
+			key:          "eheheh:eheheheh",
+			expectID:     keyFingerprint([]byte("eheheh:eheheheh")),
+			expectSecret: "eheheh:eheheheh",
+		},
+		{
+			description:  "labelled key with invalid secret",
+			key:          "key2:tooshort",
+			expectID:     keyFingerprint([]byte("key2:tooshort")),
+			expectSecret: "key2:tooshort",
+		},
+		{
+			description:  "base64 key",
+			key:          "base64:ZWhlaGVoZWhlaGVoZWhlaGVoZWhlaGVoZWhlaGVoZWg=",
+			expectID:     keyFingerprint([]byte("eheheheheheheheheheheheheheheheh")),
+			expectSecret: "eheheheheheheheheheheheheheheheh",
+		},
+		{
+			description:  "labelled hex key",
+			key:          "key2:hex:6568656865686568656865686568656865686568656865686568656865686568",
+			expectID:     "key2",
+			expectSecret: "eheheheheheheheheheheheheheheheh",
+		},
+		{
+			description:  "base64 key with invalid length",
+			key:          "base64:dG9vc2hvcnQ=",
+			expectID:     keyFingerprint([]byte("base64:dG9vc2hvcnQ=")),
+			expectSecret: "base64:dG9vc2hvcnQ=",
+		},
+		{
+			description:  "passphrase key",
+			key:          "passphrase:correct horse battery staple",
+			expectID:     "",
+			expectSecret: "",
+		},
+	}
+
+	for _, tc := range testCases {
+
+		k := parseKey(tc.key)
+		assert.Equal(t, tc.expectID, k.id, tc.description)
+		assert.Equal(t, tc.expectSecret, string(k.secret.Bytes()), tc.description)
+	}
+}
+
+func TestKeyIDs(t *testing.T) {
+
+	var (
+		secretKey1 = "key1:eheheheheheheheheheheheheheheheh"
+		secretKey2 = "key2:mylongsecdddddwwwwdtmylongsecret"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v1, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	v1.Put("/key", []byte(secretData))
+
+	fd := readFileData(t, testRootDir, "/key")
+	assert.Equal(t, "key1", fd.KeyID, "key id stored")
+
+	// the key id is missing from the keyring
+	v2, _ := Open(testRootDir, WithEncryptionKeys(secretKey2))
+	_, err = v2.Get("/key")
+	assert.True(t, errors.Is(err, ErrDecrypt), "missing key id")
+	assert.True(t, strings.Contains(err.Error(), "key1"), "missing key id named")
+
+	// rollover goes straight to key1, and re-encrypts with key2
+	v3, _ := Open(testRootDir, WithEncryptionKeys(secretKey2, secretKey1))
+	data, err := v3.Get("/key")
+	assert.Equal(t, nil, err, "rollover")
+	assert.Equal(t, secretData, string(data), "rollover")
+	assert.Equal(t, "key2", readFileData(t, testRootDir, "/key").KeyID, "rolled key id")
+
+	// tampered data is corrupt, not a wrong key
+	fd = readFileData(t, testRootDir, "/key")
+	fd.Data[len(fd.Data)-1] ^= 0xff
+	writeFileData(t, testRootDir, "/key", fd)
+
+	_, err = v3.Get("/key")
+	assert.True(t, errors.Is(err, ErrCorrupt), "tampered data")
+
+	// a repeated label would send reads to the wrong key
+	_, err = Open(testRootDir, WithEncryptionKeys(secretKey2, "key2:eheheheheheheheheheheheheheheheh"))
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "duplicate key id")
+
+	// a raw key with a colon could be either, so is neither
+	_, err = Open(testRootDir, WithEncryptionKeys("abcdefg:0123456789abcdef01234567"))
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "ambiguous key")
+
+	_, err = Open(testRootDir, WithEncryptionKeys("key3:abcdefg:0123456789abcdef01234567"))
+	assert.Equal(t, nil, err, "labelled key with a colon")
+}
+
+/*
+Test data stored before key ids existed is still read by trying each key.
+*/
+func TestKeyIDsLegacyData(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretKey2 = "mylongsecdddddwwwwdtmylongsecret"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	cipherData, _ := encryption.Encrypt([]byte(secretKey1), []byte(secretData))
+	writeFileData(t, testRootDir, "/key", &filedata.FileData{
+		Data:   cipherData,
+		Cipher: "AES-GCM",
+	})
+
+	v, _ := Open(testRootDir, WithEncryptionKeys(secretKey2, secretKey1))
+	data, err := v.Get("/key")
+	assert.Equal(t, nil, err, "legacy data")
+	assert.Equal(t, secretData, string(data), "legacy data")
+
+	// the re-encrypted data has a key id
+	assert.Equal(t, keyFingerprint([]byte(secretKey2)), readFileData(t, testRootDir, "/key").KeyID, "legacy data key id")
+}
+
+func readFileData(t *testing.T, vaultRoot string, vaultKey string) *filedata.FileData {
+
+	content, err := os.ReadFile(filepath.Join(vaultRoot, vaultKey))
+	assert.Equal(t, nil, err, "read file data")
+
+	fd := &filedata.FileData{}
+	assert.Equal(t, nil, json.Unmarshal(content, fd), "read file data")
+
+	return fd
+}
+
+func writeFileData(t *testing.T, vaultRoot string, vaultKey string, fd *filedata.FileData) {
+
+	content, _ := json.Marshal(fd)
+	err := os.WriteFile(filepath.Join(vaultRoot, vaultKey), content, 0644)
+	assert.Equal(t, nil, err, "write file data")
+}
+
+/*
+Test encrypted data copied to another vault key fails to decrypt.
+*/
+func TestAdditionalData(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	v.Put("/user/1/passphrase", []byte("user1 secret"))
+	v.Put("/user/2/passphrase", []byte("user2 secret"))
+
+	// the same key written differently is the same vault key
+	data, err := v.Get("user/1//passphrase")
+	assert.Equal(t, nil, err, "canonical key")
+	assert.Equal(t, "user1 secret", string(data), "canonical key")
+
+	// swap user1's passphrase in for user2
+	content, _ := os.ReadFile(filepath.Join(testRootDir, "user", "1", "passphrase"))
+	os.WriteFile(filepath.Join(testRootDir, "user", "2", "passphrase"), content, 0644)
+
+	_, err = v.Get("/user/2/passphrase")
+	assert.True(t, errors.Is(err, ErrCorrupt), "swapped file")
+}
+
+/*
+Test legacy data, not bound to its vault key, is migrated on read, and can
+be refused once migrated.
+*/
+func TestAdditionalDataLegacy(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	cipherData, _ := encryption.Encrypt([]byte(secretKey1), []byte(secretData))
+	legacy := &filedata.FileData{
+		Data:   cipherData,
+		Cipher: "AES-GCM",
+	}
+	writeFileData(t, testRootDir, "/key1", legacy)
+
+	// legacy reads can be refused
+	strict, _ := Open(testRootDir, WithEncryptionKeys(secretKey1), WithLegacyReads(false))
+	_, err = strict.Get("/key1")
+	assert.True(t, errors.Is(err, ErrDecrypt), "strict legacy read")
+
+	// by default legacy data is read, and re-stored bound to its key
+	v, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	data, err := v.Get("/key1")
+	assert.Equal(t, nil, err, "legacy read")
+	assert.Equal(t, secretData, string(data), "legacy read")
+	assert.Equal(t, formatVersion, readFileData(t, testRootDir, "/key1").Version, "migrated version")
+
+	data, err = strict.Get("/key1")
+	assert.Equal(t, nil, err, "strict migrated read")
+	assert.Equal(t, secretData, string(data), "strict migrated read")
+}
@@ -0,0 +1,157 @@
+package fsvault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// KeyProvider supplies encryption keys, primary first, as key strings in
+// any format FSVAULT_SECRET_KEYS accepts, see parseKey. Implement it to get
+// keys from a key management service, rather than the environment.
+type KeyProvider interface {
+	Keys(ctx context.Context) ([]string, error)
+}
+
+// WithKeyProvider sets the encryption keys from p, replacing any others.
+// Open returns the error if p fails.
+func WithKeyProvider(p KeyProvider) Option {
+	return func(v *Vault) {
+		v.provider = p
+	}
+}
+
+// LoadKeys sets the package level encryption keys from p, replacing those
+// from the environment. The keys are unchanged if p fails, or any key is
+// invalid. Once the keys are set, any other invalid config from the
+// environment is returned, as by Configure.
+//
+// LoadKeys can be called while the vault is in use, e.g. to refresh keys
+// from a key management service. Calls already running keep the keys they
+// started with.
+func LoadKeys(ctx context.Context, p KeyProvider) error {
+
+	keys, err := p.Keys(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	parsed := sharedKeys(keys)
+
+	if err := validateKeys(parsed); err != nil {
+		return err
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	if err := validateCipherKey(cipher, parsed); err != nil {
+		return err
+	}
+
+	encryptionKeys = keys
+	configErr = keysConfigError(nil)
+
+	dropUnusedKeys()
+
+	return configErr
+}
+
+// KeyFile returns a KeyProvider that reads keys from the file at path, one
+// per line or separated by commas. Blank lines and lines starting with '#'
+// are ignored. The file must be a regular file that only its owner can
+// access, e.g. mode 0600 or 0400.
+func KeyFile(path string) KeyProvider {
+	return keyFile(path)
+}
+
+type keyFile string
+
+func (f keyFile) Keys(ctx context.Context) ([]string, error) {
+
+	info, err := os.Stat(string(f))
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("key file %s is not a regular file", string(f))
+	}
+
+	// Windows doesn't have unix permissions to check
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%w: key file %s can be accessed by other users, mode %#o",
+			ErrPermission, string(f), info.Mode().Perm())
+	}
+
+	content, err := os.ReadFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+
+	return splitKeys(string(content)), nil
+}
+
+// KeyCommand returns a KeyProvider that runs a command, and reads keys
+// from its output in the same format as KeyFile. The command is run
+// directly, not through a shell. A command that fails, or writes no keys,
+// is an error.
+func KeyCommand(name string, args ...string) KeyProvider {
+	return keyCommand{name: name, args: args}
+}
+
+type keyCommand struct {
+	name string
+	args []string
+}
+
+func (c keyCommand) Keys(ctx context.Context) ([]string, error) {
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, c.name, c.args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	// the output is never part of the error, it holds the keys
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("key command %s: %w: %s", c.name, err,
+			strings.TrimSpace(stderr.String()))
+	}
+
+	keys := splitKeys(stdout.String())
+	if len(keys) == 0 {
+		return nil, errors.New("key command " + c.name + ": no keys")
+	}
+
+	return keys, nil
+}
+
+// splitKeys returns the keys in s, separated by commas or newlines.
+// Blank lines and lines starting with '#' are ignored.
+func splitKeys(s string) []string {
+
+	keys := []string{}
+
+	for _, line := range strings.Split(s, "\n") {
+
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		for _, k := range strings.Split(line, ",") {
+
+			k = strings.TrimSpace(k)
+			if k != "" {
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,266 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKMS is a local stand in for a key management service.
+type fakeKMS struct {
+	keys []string
+	err  error
+}
+
+func (f *fakeKMS) Keys(ctx context.Context) ([]string, error) {
+	return f.keys, f.err
+}
+
+func TestKeyFile(t *testing.T) {
+
+	testCases := []struct {
+		description string
+		content     string
+		perm        os.FileMode
+		expectKeys  []string
+		expectError error
+	}{
+		{
+			description: "one key per line",
+			content:     "# primary\nkey2:mylongsecdddddwwwwdtmylongsecret\n\nkey1:eheheheheheheheheheheheheheheheh\n",
+			perm:        0600,
+			expectKeys:  []string{"key2:mylongsecdddddwwwwdtmylongsecret", "key1:eheheheheheheheheheheheheheheheh"},
+		},
+		{
+			description: "comma separated",
+			content:     "key2:mylongsecdddddwwwwdtmylongsecret, key1:eheheheheheheheheheheheheheheheh",
+			perm:        0400,
+			expectKeys:  []string{"key2:mylongsecdddddwwwwdtmylongsecret", "key1:eheheheheheheheheheheheheheheheh"},
+		},
+		{
+			description: "readable by others",
+			content:     "key1:eheheheheheheheheheheheheheheheh",
+			perm:        0644,
+			expectError: ErrPermission,
+		},
+	}
+
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix permissions")
+	}
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	keyFile := filepath.Join(testRootDir, "keys")
+
+	for _, tc := range testCases {
+
+		os.Remove(keyFile)
+		os.WriteFile(keyFile, []byte(tc.content), tc.perm)
+
+		keys, err := KeyFile(keyFile).Keys(context.Background())
+		if tc.expectError != nil {
+			assert.True(t, errors.Is(err, tc.expectError), tc.description)
+			continue
+		}
+
+		assert.Equal(t, nil, err, tc.description)
+		assert.Equal(t, tc.expectKeys, keys, tc.description)
+	}
+
+	_, err = KeyFile(testRootDir).Keys(context.Background())
+	assert.NotEqual(t, nil, err, "directory")
+
+	_, err = KeyFile(filepath.Join(testRootDir, "missing")).Keys(context.Background())
+	assert.True(t, errors.Is(err, os.ErrNotExist), "missing file")
+}
+
+func TestKeyCommand(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("no sh")
+	}
+
+	keys, err := KeyCommand("sh", "-c", "echo key1:eheheheheheheheheheheheheheheheh").Keys(context.Background())
+	assert.Equal(t, nil, err, "command")
+	assert.Equal(t, []string{"key1:eheheheheheheheheheheheheheheheh"}, keys, "command")
+
+	_, err = KeyCommand("sh", "-c", "echo vault sealed >&2; exit 1").Keys(context.Background())
+	assert.ErrorContains(t, err, "vault sealed", "failed command")
+
+	_, err = KeyCommand("sh", "-c", "true").Keys(context.Background())
+	assert.NotEqual(t, nil, err, "no keys")
+}
+
+func TestKeyProvider(t *testing.T) {
+
+	var (
+		secretKey1 = "key1:eheheheheheheheheheheheheheheheh"
+		secretKey2 = "key2:mylongsecdddddwwwwdtmylongsecret"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	kms := &fakeKMS{keys: []string{secretKey1}}
+
+	v1, err := Open(testRootDir, WithKeyProvider(kms))
+	assert.Equal(t, nil, err, "open")
+	assert.Equal(t, nil, v1.Put("/key", []byte(secretData)), "put")
+	assert.Equal(t, "key1", readFileData(t, testRootDir, "/key").KeyID, "provider key")
+
+	kms.keys = []string{secretKey2, secretKey1}
+	v2, _ := Open(testRootDir, WithKeyProvider(kms))
+	data, err := v2.Get("/key")
+	assert.Equal(t, nil, err, "rolled keys")
+	assert.Equal(t, secretData, string(data), "rolled keys")
+	assert.Equal(t, "key2", readFileData(t, testRootDir, "/key").KeyID, "rolled keys")
+
+	kms.err = errors.New("kms unavailable")
+	_, err = Open(testRootDir, WithKeyProvider(kms))
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "provider error")
+
+	kms.err = nil
+	kms.keys = []string{"tooshort"}
+	_, err = Open(testRootDir, WithKeyProvider(kms))
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "invalid provider key")
+
+	// package level keys
+	defer Configure()
+
+	kms.keys = []string{secretKey2}
+	assert.Equal(t, nil, LoadKeys(context.Background(), kms), "load keys")
+	data, err = Get(testRootDir, "/key")
+	assert.Equal(t, nil, err, "package level get")
+	assert.Equal(t, secretData, string(data), "package level get")
+
+	kms.keys = []string{"tooshort"}
+	err = LoadKeys(context.Background(), kms)
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "load invalid keys")
+	assert.Equal(t, []string{secretKey2}, encryptionKeys, "keys unchanged")
+
+	// new keys don't hide the rest of the config being invalid
+	defer os.Unsetenv("FSVAULT_ROTATE_ON_READ")
+	os.Setenv("FSVAULT_ROTATE_ON_READ", "bogus")
+	Configure()
+
+	kms.keys = []string{secretKey1}
+	err = LoadKeys(context.Background(), kms)
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "load keys with invalid config")
+	assert.Equal(t, []string{secretKey1}, encryptionKeys, "keys loaded")
+	assert.True(t, errors.Is(Put(testRootDir, "/key", []byte(secretData)), ErrInvalidConfig),
+		"package level put")
+
+	// but do replace invalid keys from the environment
+	os.Unsetenv("FSVAULT_ROTATE_ON_READ")
+	os.Setenv("FSVAULT_SECRET_KEYS", "tooshort")
+	defer os.Unsetenv("FSVAULT_SECRET_KEYS")
+	assert.True(t, errors.Is(Configure(), ErrInvalidConfig), "invalid environment keys")
+
+	assert.Equal(t, nil, LoadKeys(context.Background(), kms), "load keys over invalid keys")
+	assert.Equal(t, nil, Put(testRootDir, "/key", []byte(secretData)), "package level put")
+}
+
+/*
+Test the package level keys can be reloaded while they are in use, e.g.
+refreshed from a key management service. Run with -race.
+*/
+func TestLoadKeysInUse(t *testing.T) {
+
+	var (
+		secretKey1 = "key1:eheheheheheheheheheheheheheheheh"
+		secretKey2 = "key2:mylongsecdddddwwwwdtmylongsecret"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	// restore the package level config
+	defer Configure()
+
+	rolled := []*fakeKMS{
+		{keys: []string{secretKey1, secretKey2}},
+		{keys: []string{secretKey2, secretKey1}},
+	}
+	assert.Equal(t, nil, LoadKeys(context.Background(), rolled[0]), "load keys")
+
+	done := make(chan bool)
+
+	go func() {
+		for i := 0; i < 20; i++ {
+			LoadKeys(context.Background(), rolled[i%2])
+		}
+		done <- true
+	}()
+
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, nil, Put(testRootDir, "/key", []byte(secretData)), "put")
+
+		data, err := Get(testRootDir, "/key")
+		assert.Equal(t, nil, err, "get")
+		assert.Equal(t, secretData, string(data), "get")
+	}
+
+	<-done
+}
+
+func TestConfigureKeySources(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	// restore the package level config
+	defer func() {
+		os.Unsetenv("FSVAULT_SECRET_KEYS")
+		os.Unsetenv("FSVAULT_SECRET_KEYS_FILE")
+		os.Unsetenv("FSVAULT_SECRET_KEYS_COMMAND")
+		Configure()
+	}()
+
+	keyFile := filepath.Join(testRootDir, "keys")
+	os.WriteFile(keyFile, []byte("key1:eheheheheheheheheheheheheheheheh\n"), 0600)
+
+	os.Setenv("FSVAULT_SECRET_KEYS_FILE", keyFile)
+	assert.Equal(t, nil, Configure(), "key file")
+	assert.Equal(t, []string{"key1:eheheheheheheheheheheheheheheheh"}, encryptionKeys, "key file")
+
+	os.Setenv("FSVAULT_SECRET_KEYS", "key2:mylongsecdddddwwwwdtmylongsecret")
+	assert.True(t, errors.Is(Configure(), ErrInvalidConfig), "two key sources")
+
+	os.Unsetenv("FSVAULT_SECRET_KEYS")
+	os.Chmod(keyFile, 0644)
+	err = Configure()
+	if runtime.GOOS != "windows" {
+		assert.True(t, errors.Is(err, ErrPermission), "key file permissions")
+		assert.True(t, errors.Is(err, ErrInvalidConfig), "key file permissions")
+	}
+
+	if runtime.GOOS != "windows" {
+		os.Unsetenv("FSVAULT_SECRET_KEYS_FILE")
+		os.Setenv("FSVAULT_SECRET_KEYS_COMMAND", "cat "+keyFile)
+		assert.Equal(t, nil, Configure(), "key command")
+		assert.Equal(t, []string{"key1:eheheheheheheheheheheheheheheheh"}, encryptionKeys, "key command")
+	}
+}
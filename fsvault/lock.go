@@ -0,0 +1,183 @@
+package fsvault
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// LockKey acquires the lock for vaultKey without reading it, waiting until
+// it is free. The caller must Unlock() the lock.
+func LockKey(vaultRoot string, vaultKey string) Unlocker {
+	return vaultAt(vaultRoot).LockKey(vaultKey)
+}
+
+// TryLockKey acquires the lock for vaultKey only if it is free. When ok is
+// false someone else holds the lock, otherwise the caller must Unlock() it.
+func TryLockKey(vaultRoot string, vaultKey string) (lock Unlocker, ok bool) {
+	return vaultAt(vaultRoot).TryLockKey(vaultKey)
+}
+
+// RLockKey acquires a shared lock for vaultKey, held alongside other
+// readers but excluding LockKey. The caller must Unlock() the lock.
+func RLockKey(vaultRoot string, vaultKey string) Unlocker {
+	return vaultAt(vaultRoot).RLockKey(vaultKey)
+}
+
+// TryRLockKey acquires a shared lock for vaultKey only if no writer holds,
+// or is waiting for, the lock. When ok is true the caller must Unlock() it.
+func TryRLockKey(vaultRoot string, vaultKey string) (lock Unlocker, ok bool) {
+	return vaultAt(vaultRoot).TryRLockKey(vaultKey)
+}
+
+// LockKeyTimeout acquires the lock for vaultKey, waiting at most d. On
+// timeout the Unlocker is nil and the error wraps context.DeadlineExceeded.
+func LockKeyTimeout(vaultRoot string, vaultKey string, d time.Duration) (Unlocker, error) {
+	return vaultAt(vaultRoot).LockKeyTimeout(vaultKey, d)
+}
+
+// LockKeyContext acquires the lock for vaultKey, or gives up when ctx is
+// done returning a nil Unlocker and an error wrapping ctx.Err().
+func LockKeyContext(ctx context.Context, vaultRoot string, vaultKey string) (Unlocker, error) {
+	return vaultAt(vaultRoot).LockKeyContext(ctx, vaultKey)
+}
+
+// LockKey acquires the lock for vaultKey without reading it, waiting until
+// it is free. The caller must Unlock() the lock. With LockFile, if the lock
+// file can't be taken only the in-process lock is held, use LockKeyContext
+// to get the error.
+func (v *Vault) LockKey(vaultKey string) Unlocker {
+	return v.lockOrLog(vaultKey, false)
+}
+
+// TryLockKey acquires the lock for vaultKey only if it is free. When ok is
+// false someone else holds the lock, otherwise the caller must Unlock() it.
+func (v *Vault) TryLockKey(vaultKey string) (lock Unlocker, ok bool) {
+	return v.tryLock(vaultKey, false)
+}
+
+// RLockKey acquires a shared lock for vaultKey, held alongside other
+// readers but excluding LockKey. The caller must Unlock() the lock. Like
+// LockKey, a lock file that can't be taken is only logged.
+func (v *Vault) RLockKey(vaultKey string) Unlocker {
+	return v.lockOrLog(vaultKey, true)
+}
+
+// TryRLockKey acquires a shared lock for vaultKey only if no writer holds,
+// or is waiting for, the lock. When ok is true the caller must Unlock() it.
+func (v *Vault) TryRLockKey(vaultKey string) (lock Unlocker, ok bool) {
+	return v.tryLock(vaultKey, true)
+}
+
+// LockKeyTimeout acquires the lock for vaultKey, waiting at most d. On
+// timeout the Unlocker is nil and the error wraps context.DeadlineExceeded.
+func (v *Vault) LockKeyTimeout(vaultKey string, d time.Duration) (Unlocker, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	return v.lockContext(ctx, vaultKey, false)
+}
+
+// LockKeyContext acquires the lock for vaultKey, or gives up when ctx is
+// done returning a nil Unlocker and an error wrapping ctx.Err().
+func (v *Vault) LockKeyContext(ctx context.Context, vaultKey string) (Unlocker, error) {
+	return v.lockContext(ctx, vaultKey, false)
+}
+
+// lock acquires the in-process lock for vaultKey and, with LockFile, the
+// lock file, shared or exclusive. If the lock file can't be taken neither
+// lock is held, and the Unlocker does nothing so callers can always
+// Unlock() it.
+func (v *Vault) lock(vaultKey string, shared bool) (Unlocker, error) {
+
+	lock, err := v.lockContext(context.Background(), vaultKey, shared)
+	if err != nil {
+		return noLock{}, err
+	}
+
+	return lock, nil
+}
+
+// lockOrLog is lock for callers with no error to return, which log the
+// error and hold only the in-process lock.
+func (v *Vault) lockOrLog(vaultKey string, shared bool) Unlocker {
+
+	lock, err := v.lock(vaultKey, shared)
+	if err == nil {
+		return lock
+	}
+
+	log.Println("fsvault.lock(): failed to lock file for key", vaultKey, err)
+
+	if shared {
+		return v.locker.rlock(vaultKey)
+	}
+
+	return v.locker.lock(vaultKey)
+}
+
+// noLock stands in for a lock that couldn't be taken.
+type noLock struct{}
+
+// Unlock does nothing.
+func (noLock) Unlock() {}
+
+// lockContext acquires the in-process lock for vaultKey and, with LockFile,
+// the lock file, shared or exclusive, or gives up when ctx is done.
+func (v *Vault) lockContext(ctx context.Context, vaultKey string, shared bool) (Unlocker, error) {
+
+	var lock Unlocker
+	var err error
+	if shared {
+		lock, err = v.locker.rlockContext(ctx, vaultKey)
+	} else {
+		lock, err = v.locker.lockContext(ctx, vaultKey)
+	}
+	if err != nil {
+		return nil, keyError("lock", vaultKey, err)
+	}
+
+	if v.lockMode != LockFile {
+		return lock, nil
+	}
+
+	f, err := v.lockFileContext(ctx, vaultKey, shared)
+	if err != nil {
+		lock.Unlock()
+		return nil, keyError("lock", vaultKey, err)
+	}
+
+	return &fileLock{inProcess: lock, file: f}, nil
+}
+
+// tryLock acquires the in-process lock for vaultKey and, with LockFile, the
+// lock file, shared or exclusive, only if both are available.
+func (v *Vault) tryLock(vaultKey string, shared bool) (Unlocker, bool) {
+
+	var lock Unlocker
+	var ok bool
+	if shared {
+		lock, ok = v.locker.tryRLock(vaultKey)
+	} else {
+		lock, ok = v.locker.tryLock(vaultKey)
+	}
+	if !ok {
+		return nil, false
+	}
+
+	if v.lockMode != LockFile {
+		return lock, true
+	}
+
+	f, ok, err := v.tryLockFile(vaultKey, shared)
+	if err != nil {
+		log.Println("fsvault.tryLock(): failed to lock file for key", vaultKey, err)
+	}
+	if !ok {
+		lock.Unlock()
+		return nil, false
+	}
+
+	return &fileLock{inProcess: lock, file: f}, true
+}
@@ -1,142 +1,342 @@
 package fsvault
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"strings"
 )
 
+// Map provides the map helpers for values of type V stored in a Vault.
+// Go methods can't take type parameters, so the value type is bound here.
+//
+// Unlike the package level map functions, Map methods return errors. A map
+// or entry that doesn't exist is ErrNotFound, data that can't be decoded as
+// a map is ErrCorrupt, and data that can't be decrypted is ErrDecrypt.
+type Map[V any] struct {
+	vault *Vault
+}
+
+// MapOf returns the map helpers for values of type V in vault v.
+func MapOf[V any](v *Vault) Map[V] {
+	return Map[V]{vault: v}
+}
+
+// MapAt returns the map helpers for values of type V at vaultRoot, using
+// the same configuration as the package level functions.
+func MapAt[V any](vaultRoot string) Map[V] {
+	return Map[V]{vault: vaultAt(vaultRoot)}
+}
+
 // GetMapWithLock returns the map with a lock the caller must
 // unlock. If the map doesn't exist, the key lock is still
-// returned.
+// returned. Like LockKey, if the lock file can't be taken only the
+// in-process lock is held, use MapAt().GetWithLock() to get the error.
 func GetMapWithLock[V any](vaultRoot string, vaultKey string) (Unlocker, map[string]V) {
 
-	lock := keylocker.lock(vaultKey)
-	data := GetMap[V](vaultRoot, vaultKey)
+	m := MapAt[V](vaultRoot)
+	lock := m.vault.lockOrLog(vaultKey, false)
+
+	data, err := m.Get(vaultKey)
+	logMapError("fsvault.GetMapWithLock():", err)
 
 	return lock, data
 }
 
-// GetMap returns the map at key, or an empty map if it doesn't exist.
-func GetMap[V any](vaultRoot string, vaultKey string) map[string]V {
+// GetMapWithLockContext is GetMapWithLock, but gives up waiting for the
+// lock when ctx is done, returning a nil Unlocker and the error. If the lock
+// is acquired the caller must unlock it, even if there is an error.
+func GetMapWithLockContext[V any](ctx context.Context, vaultRoot string, vaultKey string) (Unlocker, map[string]V, error) {
+	return MapAt[V](vaultRoot).GetWithLockContext(ctx, vaultKey)
+}
 
-	data := make(map[string]V)
+// GetMapWithRLock returns the map with a shared lock the caller must
+// unlock. Readers don't block each other, only writers holding the lock.
+// Like RLockKey, a lock file that can't be taken is only logged.
+func GetMapWithRLock[V any](vaultRoot string, vaultKey string) (Unlocker, map[string]V) {
 
-	// get map
-	dataBytes, err := Get(vaultRoot, vaultKey)
-	if err != nil {
-		return data
-	}
+	m := MapAt[V](vaultRoot)
+	lock := m.vault.lockOrLog(vaultKey, true)
 
-	// if we have data then...
-	if len(dataBytes) > 0 {
-		json.Unmarshal(dataBytes, &data)
-	}
+	data, err := m.Get(vaultKey)
+	logMapError("fsvault.GetMapWithRLock():", err)
+
+	return lock, data
+}
+
+// GetMap returns the map at key, or an empty map if it doesn't exist.
+//
+// An empty map is also returned if the map can't be read, use
+// MapAt().Get() to tell the difference.
+func GetMap[V any](vaultRoot string, vaultKey string) map[string]V {
+
+	data, err := MapAt[V](vaultRoot).Get(vaultKey)
+	logMapError("fsvault.GetMap():", err)
 
 	return data
 }
 
 // GetMapValueWithLock returns the value and a lock on the map, the caller
-// must release the lock.
+// must release the lock. Like LockKey, a lock file that can't be taken is
+// only logged.
 func GetMapValueWithLock[V any](vaultRoot string, vaultKey string, mapKey string) (Unlocker, V) {
 
-	lock := keylocker.lock(vaultKey)
-	data := GetMapValue[V](vaultRoot, vaultKey, mapKey)
+	m := MapAt[V](vaultRoot)
+	lock := m.vault.lockOrLog(vaultKey, false)
 
-	return lock, data
+	value, err := m.GetValue(vaultKey, mapKey)
+	logMapError("fsvault.GetMapValueWithLock():", err)
+
+	return lock, value
+}
+
+// GetMapValueWithLockContext is GetMapValueWithLock, but gives up waiting
+// for the lock when ctx is done, returning a nil Unlocker and the error. If
+// the lock is acquired the caller must unlock it, even if there is an error.
+func GetMapValueWithLockContext[V any](ctx context.Context, vaultRoot string, vaultKey string, mapKey string) (Unlocker, V, error) {
+	return MapAt[V](vaultRoot).GetValueWithLockContext(ctx, vaultKey, mapKey)
+}
+
+// GetMapValueWithRLock returns the value and a shared lock on the map, the
+// caller must release the lock. Like RLockKey, a lock file that can't be
+// taken is only logged.
+func GetMapValueWithRLock[V any](vaultRoot string, vaultKey string, mapKey string) (Unlocker, V) {
+
+	m := MapAt[V](vaultRoot)
+	lock := m.vault.lockOrLog(vaultKey, true)
+
+	value, err := m.GetValue(vaultKey, mapKey)
+	logMapError("fsvault.GetMapValueWithRLock():", err)
+
+	return lock, value
 }
 
+// GetMapValue returns the value at mapKey, or the zero value if it doesn't
+// exist.
+//
+// The zero value is also returned if the map can't be read, use
+// MapAt().GetValue() to tell the difference.
 func GetMapValue[V any](vaultRoot string, vaultKey string, mapKey string) V {
 
-	var value V
+	value, err := MapAt[V](vaultRoot).GetValue(vaultKey, mapKey)
+	logMapError("fsvault.GetMapValue():", err)
 
-	// get map
-	dataBytes, err := Get(vaultRoot, vaultKey)
+	return value
+}
+
+// PutMapValue adds value at mapKey, or overwrites value if it exists. A map
+// that exists but can't be read is not overwritten, use MapAt().PutValue()
+// to get the error.
+func PutMapValue[V any](vaultRoot string, vaultKey string, mapKey string, value V) {
+
+	err := MapAt[V](vaultRoot).PutValue(vaultKey, mapKey, value)
+	logMapError("fsvault.PutMapValue():", err)
+}
+
+// DeleteMapValue removes the entry at mapKey, if it exists. Use
+// MapAt().DeleteValue() to get any error.
+func DeleteMapValue[V any](vaultRoot string, vaultKey string, mapKey string) {
+
+	err := MapAt[V](vaultRoot).DeleteValue(vaultKey, mapKey)
+	logMapError("fsvault.DeleteMapValue():", err)
+}
+
+// logMapError logs errors the package level map functions can't return.
+// Missing maps and entries are expected, so aren't logged.
+func logMapError(caller string, err error) {
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Println(caller, err)
+	}
+}
+
+// GetWithLock returns the map with a lock the caller must unlock, even if
+// there is an error. If the map doesn't exist the error is ErrNotFound.
+func (m Map[V]) GetWithLock(vaultKey string) (Unlocker, map[string]V, error) {
+
+	lock, err := m.vault.lock(vaultKey, false)
 	if err != nil {
-		// if the changelog doesn't exist yet, that's ok, otherwise...
-		if !strings.Contains(err.Error(), "no such file or directory") {
-			log.Println("fsvault.datastore.MapGet():", err)
-			return value
-		}
+		return lock, make(map[string]V), err
 	}
 
-	data := make(map[string]V)
+	data, err := m.Get(vaultKey)
 
-	// if we have data then...
-	if len(dataBytes) > 0 {
-		json.Unmarshal(dataBytes, &data)
+	return lock, data, err
+}
+
+// GetWithLockContext is GetWithLock, but gives up waiting for the lock when
+// ctx is done, returning a nil Unlocker and the error.
+func (m Map[V]) GetWithLockContext(ctx context.Context, vaultKey string) (Unlocker, map[string]V, error) {
+
+	lock, err := m.vault.lockContext(ctx, vaultKey, false)
+	if err != nil {
+		return nil, make(map[string]V), err
 	}
 
-	// if the entry exists...
-	_, ok := data[mapKey]
-	if ok {
-		return data[mapKey]
+	data, err := m.Get(vaultKey)
+
+	return lock, data, err
+}
+
+// GetWithRLock returns the map with a shared lock the caller must unlock,
+// even if there is an error. Readers don't block each other, only writers
+// holding the lock.
+func (m Map[V]) GetWithRLock(vaultKey string) (Unlocker, map[string]V, error) {
+
+	lock, err := m.vault.lock(vaultKey, true)
+	if err != nil {
+		return lock, make(map[string]V), err
 	}
 
-	return value
+	data, err := m.Get(vaultKey)
+
+	return lock, data, err
 }
 
-// PutMapValue adds value at mapKey, or overwrites value if it exists
-func PutMapValue[V any](vaultRoot string, vaultKey string, mapKey string, value V) {
+// Get returns the map at key. If there is an error the map is empty, but
+// never nil.
+func (m Map[V]) Get(vaultKey string) (map[string]V, error) {
 
-	// get map assuming any prior read call already has a lock
-	dataBytes, err := Get(vaultRoot, vaultKey)
+	// get map
+	dataBytes, err := m.vault.Get(vaultKey)
 	if err != nil {
-		// if the changelog doesn't exist yet, that's ok, otherwise...
-		if !strings.Contains(err.Error(), "no such file or directory") {
-			log.Println("fsvault.datastore.MapPut():", err)
-			return
-		}
+		return make(map[string]V), err
 	}
 
-	mapData := make(map[string]V)
+	return decodeMap[V](vaultKey, dataBytes)
+}
 
-	// if we have data then...
-	if len(dataBytes) > 0 {
-		json.Unmarshal(dataBytes, &mapData)
+// GetValueWithLock returns the value and a lock on the map, the caller
+// must release the lock even if there is an error.
+func (m Map[V]) GetValueWithLock(vaultKey string, mapKey string) (Unlocker, V, error) {
+
+	var value V
+
+	lock, err := m.vault.lock(vaultKey, false)
+	if err != nil {
+		return lock, value, err
 	}
 
-	// add/overwrite entry
-	mapData[mapKey] = value
+	value, err = m.GetValue(vaultKey, mapKey)
 
-	dataBytes, _ = json.Marshal(mapData)
+	return lock, value, err
+}
+
+// GetValueWithLockContext is GetValueWithLock, but gives up waiting for the
+// lock when ctx is done, returning a nil Unlocker and the error.
+func (m Map[V]) GetValueWithLockContext(ctx context.Context, vaultKey string, mapKey string) (Unlocker, V, error) {
+
+	var value V
 
-	err = Put(vaultRoot, vaultKey, dataBytes)
+	lock, err := m.vault.lockContext(ctx, vaultKey, false)
 	if err != nil {
-		log.Println("fsvault.datastore.MapPut():", err)
+		return nil, value, err
 	}
+
+	value, err = m.GetValue(vaultKey, mapKey)
+
+	return lock, value, err
 }
 
-func DeleteMapValue[V any](vaultRoot string, vaultKey string, mapKey string) {
+// GetValueWithRLock returns the value and a shared lock on the map, the
+// caller must release the lock even if there is an error.
+func (m Map[V]) GetValueWithRLock(vaultKey string, mapKey string) (Unlocker, V, error) {
 
-	// get map assuming any prior read call already has a lock
-	dataBytes, err := Get(vaultRoot, vaultKey)
+	var value V
+
+	lock, err := m.vault.lock(vaultKey, true)
 	if err != nil {
-		// if the changelog doesn't exist yet, that's ok, otherwise...
-		if !strings.Contains(err.Error(), "no such file or directory") {
-			return
-		}
+		return lock, value, err
+	}
+
+	value, err = m.GetValue(vaultKey, mapKey)
+
+	return lock, value, err
+}
+
+// GetValue returns the value at mapKey. If the map or the entry doesn't
+// exist the error is ErrNotFound, and the value is the zero value.
+func (m Map[V]) GetValue(vaultKey string, mapKey string) (V, error) {
+
+	var value V
+
+	data, err := m.Get(vaultKey)
+	if err != nil {
+		return value, err
 	}
 
-	mapData := make(map[string]V)
+	// if the entry exists...
+	value, ok := data[mapKey]
+	if !ok {
+		return value, keyError("get", vaultKey,
+			fmt.Errorf("%w: map key %s", ErrNotFound, mapKey))
+	}
+
+	return value, nil
+}
 
-	// if we have no data then...
-	if len(dataBytes) == 0 {
-		return
+// PutValue adds value at mapKey, or overwrites value if it exists. A map
+// that exists but can't be read is not overwritten.
+func (m Map[V]) PutValue(vaultKey string, mapKey string, value V) error {
+
+	// get map assuming any prior read call already has a lock
+	mapData, err := m.Get(vaultKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
 	}
 
-	json.Unmarshal(dataBytes, &mapData)
+	// add/overwrite entry
+	mapData[mapKey] = value
+
+	return m.put(vaultKey, mapData)
+}
+
+// DeleteValue removes the entry at mapKey. If the map or the entry doesn't
+// exist the error is ErrNotFound.
+func (m Map[V]) DeleteValue(vaultKey string, mapKey string) error {
+
+	// get map assuming any prior read call already has a lock
+	mapData, err := m.Get(vaultKey)
+	if err != nil {
+		return err
+	}
 
 	// if the entry doesn't exist
 	_, ok := mapData[mapKey]
 	if !ok {
-		return
+		return keyError("delete", vaultKey,
+			fmt.Errorf("%w: map key %s", ErrNotFound, mapKey))
 	}
 
 	delete(mapData, mapKey)
 
-	dataBytes, _ = json.Marshal(mapData)
-
 	// Put the map back
-	Put(vaultRoot, vaultKey, dataBytes)
+	return m.put(vaultKey, mapData)
+}
+
+// put encodes and writes the map at key.
+func (m Map[V]) put(vaultKey string, mapData map[string]V) error {
+
+	dataBytes, err := json.Marshal(mapData)
+	if err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	return m.vault.Put(vaultKey, dataBytes)
+}
+
+// decodeMap decodes the map stored at key. Empty data is an empty map.
+func decodeMap[V any](vaultKey string, dataBytes []byte) (map[string]V, error) {
+
+	data := make(map[string]V)
+
+	// if we have data then...
+	if len(dataBytes) > 0 {
+		if err := json.Unmarshal(dataBytes, &data); err != nil {
+			return make(map[string]V), keyError("get", vaultKey,
+				fmt.Errorf("%w: %w", ErrCorrupt, err))
+		}
+	}
+
+	return data, nil
 }
@@ -3,6 +3,7 @@
 package fsvault
 
 import (
+	"errors"
 	"os"
 	"testing"
 
@@ -163,3 +164,88 @@ func TestDeleteMapValue(t *testing.T) {
 	value = GetMapValue[TestValue](testRootDir, testMapKey, "key3")
 	assert.Equal(t, "value3", value.Id, "key3")
 }
+
+func TestMapErrors(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v, _ := Open(testRootDir, WithEncryptionKeys("eheheheheheheheheheheheheheheheh"))
+	wrongKey, _ := Open(testRootDir, WithEncryptionKeys("mylongsecdddddwwwwdtmylongsecret"))
+
+	m := MapOf[TestValue](v)
+	m.PutValue("/testmap", "key1", TestValue{"value1"})
+	v.Put("/notamap", []byte("not json"))
+
+	testCases := []struct {
+		description string
+		vault       *Vault
+		vaultKey    string
+		mapKey      string
+		expectError error
+	}{
+		{
+			description: "map exists",
+			vault:       v,
+			vaultKey:    "/testmap",
+			mapKey:      "key1",
+			expectError: nil,
+		},
+		{
+			description: "no map",
+			vault:       v,
+			vaultKey:    "/nomap",
+			mapKey:      "key1",
+			expectError: ErrNotFound,
+		},
+		{
+			description: "no entry",
+			vault:       v,
+			vaultKey:    "/testmap",
+			mapKey:      "keyA",
+			expectError: ErrNotFound,
+		},
+		{
+			description: "not a map",
+			vault:       v,
+			vaultKey:    "/notamap",
+			mapKey:      "key1",
+			expectError: ErrCorrupt,
+		},
+		{
+			description: "wrong encryption key",
+			vault:       wrongKey,
+			vaultKey:    "/testmap",
+			mapKey:      "key1",
+			expectError: ErrDecrypt,
+		},
+	}
+
+	for _, tc := range testCases {
+
+		_, err := MapOf[TestValue](tc.vault).GetValue(tc.vaultKey, tc.mapKey)
+		if tc.expectError == nil {
+			assert.Equal(t, nil, err, tc.description)
+		} else {
+			assert.True(t, errors.Is(err, tc.expectError), tc.description)
+		}
+	}
+
+	// a map that can't be read is never overwritten
+	err = MapOf[TestValue](wrongKey).PutValue("/testmap", "key2", TestValue{"value2"})
+	assert.True(t, errors.Is(err, ErrDecrypt), "put with wrong encryption key")
+
+	PutMapValue(testRootDir, "/notamap", "key2", TestValue{"value2"})
+	data, _ := v.Get("/notamap")
+	assert.Equal(t, "not json", string(data), "put to not a map")
+
+	value, err := m.GetValue("/testmap", "key1")
+	assert.Equal(t, nil, err, "map intact")
+	assert.Equal(t, "value1", value.Id, "map intact")
+
+	err = m.DeleteValue("/testmap", "keyA")
+	assert.True(t, errors.Is(err, ErrNotFound), "delete no entry")
+}
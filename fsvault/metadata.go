@@ -0,0 +1,89 @@
+package fsvault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// metadataName is the vault metadata file, at the vault root.
+const metadataName = internalPrefix + "meta"
+
+// vaultMetadata is the content of the vault metadata file, which holds
+// vault wide settings that must be kept with the data.
+type vaultMetadata struct {
+	KDF   *kdfParams   `json:"kdf,omitempty"`
+	Names *nameKeyData `json:"names,omitempty"`
+}
+
+// updateMetadata calls update with the vault metadata, an empty one if
+// there is none yet, and writes it back if update returns true. Updates
+// happen under the metadata lock, and update may be called more than once.
+func (v *Vault) updateMetadata(update func(meta *vaultMetadata) (bool, error)) (*vaultMetadata, error) {
+
+	metaPath := filepath.Join(v.root, metadataName)
+
+	// most of the time there is nothing to change, so don't lock
+	meta, err := readMetadata(metaPath)
+	if err == nil {
+		changed, err := update(meta)
+		if err != nil || !changed {
+			return meta, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(v.root, v.dirPerm); err != nil {
+		return nil, err
+	}
+
+	f, err := v.openLockPath(v.lockPath(metadataName, keyLockExt))
+	lock, err := v.lockExclusive(metadataName, internalLock(metadataName), f, err)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	// read again, another process may have changed it
+	meta, err = readMetadata(metaPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		meta, err = &vaultMetadata{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	changed, err := update(meta)
+	if err != nil || !changed {
+		return meta, err
+	}
+
+	metaJSON, _ := json.Marshal(meta)
+
+	if err := writeFileAtomic(metaPath, metaJSON, v.filePerm, v.durability); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// readMetadata reads the vault metadata file at metaPath.
+func readMetadata(metaPath string) (*vaultMetadata, error) {
+
+	content, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &vaultMetadata{}
+
+	if err := json.Unmarshal(content, meta); err != nil {
+		return nil, fmt.Errorf("%w: vault metadata: %w", ErrCorrupt, err)
+	}
+
+	return meta, nil
+}
@@ -0,0 +1,368 @@
+package fsvault
+
+import (
+	"crypto/aes"
+	stdcipher "crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/thisdougb/go-fsvault/internal/securemem"
+)
+
+// With encrypted names each segment of a vault key, e.g. "user" and "23"
+// in /user/23, is stored on disk as a deterministic token, so the same key
+// always finds the same file but the directory tree doesn't show the key.
+// The token is the segment encrypted with AES-CTR, using an HMAC of the
+// parent key and segment as the IV (an HMAC based SIV), so a segment can
+// only be decrypted in its parent and a changed token fails to decrypt.
+//
+// Tokens are lower case base32, safe on case insensitive filesystems. Vault
+// housekeeping files at the vault root keep their names.
+//
+// The name key is random, and kept in the vault metadata wrapped by the
+// primary encryption key. Rolling the encryption key rewraps the name key,
+// the tokens don't change.
+
+// maxNameLength is the longest key segment with encrypted names. Its token
+// is 218 bytes, leaving room for the temp file and lock file names within
+// the usual 255 byte filename limit.
+const maxNameLength = 120
+
+// nameIVSize is the length of the IV at the start of a token.
+const nameIVSize = aes.BlockSize
+
+// nameKeySize is the length of the random name key.
+const nameKeySize = 32
+
+// nameEncoding encodes tokens, lower cased.
+var nameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// nameKeyData is the wrapped name key, in the vault metadata.
+type nameKeyData struct {
+	KeyID  string `json:"keyid"`
+	Cipher string `json:"cipher"`
+	Key    []byte `json:"key"`
+}
+
+// nameCipher encrypts and decrypts key segments.
+type nameCipher struct {
+	macKey *securemem.Buffer
+	encKey *securemem.Buffer
+}
+
+// sharedNames are the name ciphers of the package level functions, by
+// vault root, so each call doesn't read and unwrap the name key again.
+var (
+	sharedNames   = map[string]*nameCipher{}
+	sharedNamesMu sync.Mutex
+)
+
+// WithEncryptedNames sets whether key names are encrypted on disk, which
+// needs encryption keys. The default is set by FSVAULT_ENCRYPT_NAMES.
+// Turning it on or off for a vault with data hides that data, as keys are
+// only looked up one way.
+func WithEncryptedNames(enabled bool) Option {
+	return func(v *Vault) {
+		v.encryptNames = enabled
+	}
+}
+
+// canonicalKey returns vaultKey as a clean, slash separated path from the
+// vault root, the form used to encrypt names.
+func canonicalKey(vaultKey string) string {
+	return path.Clean("/" + filepath.ToSlash(vaultKey))
+}
+
+// diskPath returns the path relative to the vault root for vaultKey,
+// encrypting each segment if names are encrypted.
+func (v *Vault) diskPath(vaultKey string) (string, error) {
+
+	// the vault root isn't encrypted
+	relative := strings.TrimPrefix(canonicalKey(vaultKey), "/")
+	if !v.encryptNames || relative == "" {
+		return filepath.FromSlash(relative), nil
+	}
+
+	names, err := v.nameCipher()
+	if err != nil {
+		return "", err
+	}
+
+	parent := "/"
+	tokens := []string{}
+
+	for _, segment := range strings.Split(relative, "/") {
+
+		if len(segment) > maxNameLength {
+			return "", fmt.Errorf("%w: segment is longer than %d bytes",
+				ErrInvalidKey, maxNameLength)
+		}
+
+		tokens = append(tokens, names.encrypt(parent, segment))
+		parent = path.Join(parent, segment)
+	}
+
+	return filepath.Join(tokens...), nil
+}
+
+// vaultKeyFromDisk returns the vault key for a path relative to the vault
+// root, decrypting each segment if names are encrypted.
+func (v *Vault) vaultKeyFromDisk(relativePath string) (string, error) {
+
+	vaultKey := "/"
+
+	for _, diskName := range strings.Split(filepath.ToSlash(relativePath), "/") {
+
+		name, err := v.nameFromDisk(vaultKey, diskName)
+		if err != nil {
+			return "", err
+		}
+
+		vaultKey = path.Join(vaultKey, name)
+	}
+
+	return vaultKey, nil
+}
+
+// nameFromDisk returns the name of a key in parentKey, decrypting diskName
+// if names are encrypted.
+func (v *Vault) nameFromDisk(parentKey string, diskName string) (string, error) {
+
+	if !v.encryptNames {
+		return diskName, nil
+	}
+
+	names, err := v.nameCipher()
+	if err != nil {
+		return "", err
+	}
+
+	return names.decrypt(canonicalKey(parentKey), diskName)
+}
+
+// nameCipher returns the cipher for key names, unwrapping the name key
+// from the vault metadata the first time. A new vault gets a new name key,
+// and a name key wrapped by an older key is rewrapped with the primary key.
+func (v *Vault) nameCipher() (*nameCipher, error) {
+
+	v.namesMu.Lock()
+	defer v.namesMu.Unlock()
+
+	if v.names != nil {
+		return v.names, nil
+	}
+
+	if v.keyErr != nil {
+		return nil, v.keyErr
+	}
+
+	if err := v.checkSealed(); err != nil {
+		return nil, err
+	}
+
+	if v.shared {
+		sharedNamesMu.Lock()
+		v.names = sharedNames[filepath.Clean(v.root)]
+		sharedNamesMu.Unlock()
+
+		if v.names != nil {
+			return v.names, nil
+		}
+	}
+
+	keys := v.vaultKeyring()
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: encrypted names need an encryption key",
+			ErrEncryptionRequired)
+	}
+
+	// a passphrase primary key is derived on the first write, until then
+	// names can only be read with a name key the vault already has
+	pending := keys[0].passphrase != ""
+	if pending {
+		meta, err := readMetadata(filepath.Join(v.root, metadataName))
+		if errors.Is(err, fs.ErrNotExist) || err == nil && meta.Names == nil {
+			return nil, fmt.Errorf("%w: no names have been written", ErrNotFound)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var nameKey []byte
+	defer func() { clear(nameKey) }()
+
+	_, err := v.updateMetadata(func(meta *vaultMetadata) (bool, error) {
+
+		// update can be called twice, don't leave the first key behind
+		clear(nameKey)
+
+		if meta.Names == nil {
+
+			nameKey = make([]byte, nameKeySize)
+			if _, err := rand.Read(nameKey); err != nil {
+				return false, err
+			}
+
+			wrapped, err := wrapNameKey(keys[0], v.cipher, nameKey)
+			meta.Names = wrapped
+
+			return true, err
+		}
+
+		i := keyIndex(keys, meta.Names.KeyID)
+		if i < 0 {
+			return false, fmt.Errorf("%w: name key id %s is not in the keyring",
+				ErrDecrypt, meta.Names.KeyID)
+		}
+
+		c, err := lookupCipher(meta.Names.Cipher)
+		if err != nil {
+			return false, fmt.Errorf("%w: %w", ErrDecrypt, err)
+		}
+
+		nameKey, err = c.Open(keys[i].secret.Bytes(), meta.Names.Key, []byte(nameKeyAD))
+		if err != nil {
+			return false, fmt.Errorf("%w: name key: %w", ErrCorrupt, err)
+		}
+
+		if i == 0 || pending {
+			return false, nil
+		}
+
+		wrapped, err := wrapNameKey(keys[0], v.cipher, nameKey)
+		meta.Names = wrapped
+
+		return true, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	v.names = newNameCipher(nameKey)
+
+	if v.shared {
+		v.names = shareNameCipher(v.root, v.names)
+	}
+
+	return v.names, nil
+}
+
+// shareNameCipher caches names for the package level functions at root,
+// returning the cached cipher if another call got there first.
+func shareNameCipher(root string, names *nameCipher) *nameCipher {
+
+	sharedNamesMu.Lock()
+	defer sharedNamesMu.Unlock()
+
+	if existing, ok := sharedNames[filepath.Clean(root)]; ok {
+		names.wipe()
+		return existing
+	}
+
+	sharedNames[filepath.Clean(root)] = names
+
+	return names
+}
+
+// nameKeyAD is authenticated with the wrapped name key.
+const nameKeyAD = "fsvault:names"
+
+// wrapNameKey encrypts nameKey with key.
+func wrapNameKey(key encryptionKey, cipherName string, nameKey []byte) (*nameKeyData, error) {
+
+	c, err := lookupCipher(cipherName)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := c.Seal(key.secret.Bytes(), nameKey, []byte(nameKeyAD))
+	if err != nil {
+		return nil, err
+	}
+
+	return &nameKeyData{KeyID: key.id, Cipher: c.Name(), Key: wrapped}, nil
+}
+
+// newNameCipher derives separate MAC and encryption keys from nameKey.
+func newNameCipher(nameKey []byte) *nameCipher {
+
+	derive := func(label string) *securemem.Buffer {
+		mac := hmac.New(sha256.New, nameKey)
+		mac.Write([]byte(label))
+		return securemem.Move(mac.Sum(nil))
+	}
+
+	return &nameCipher{
+		macKey: derive("fsvault names iv"),
+		encKey: derive("fsvault names encryption"),
+	}
+}
+
+// wipe zeroes the name keys.
+func (n *nameCipher) wipe() {
+	n.macKey.Wipe()
+	n.encKey.Wipe()
+}
+
+// ctr returns the AES-CTR stream for iv.
+func (n *nameCipher) ctr(iv []byte) stdcipher.Stream {
+
+	// the key is always 32 bytes, so NewCipher can't fail
+	block, _ := aes.NewCipher(n.encKey.Bytes())
+
+	return stdcipher.NewCTR(block, iv)
+}
+
+// iv returns the synthetic IV for segment in parent.
+func (n *nameCipher) iv(parent string, segment []byte) []byte {
+
+	mac := hmac.New(sha256.New, n.macKey.Bytes())
+	mac.Write([]byte(parent))
+	mac.Write([]byte{0})
+	mac.Write(segment)
+
+	return mac.Sum(nil)[:nameIVSize]
+}
+
+// encrypt returns the token for segment in parent.
+func (n *nameCipher) encrypt(parent string, segment string) string {
+
+	token := make([]byte, nameIVSize+len(segment))
+
+	iv := n.iv(parent, []byte(segment))
+	copy(token, iv)
+
+	n.ctr(iv).XORKeyStream(token[nameIVSize:], []byte(segment))
+
+	return strings.ToLower(nameEncoding.EncodeToString(token))
+}
+
+// decrypt returns the segment for token in parent.
+func (n *nameCipher) decrypt(parent string, token string) (string, error) {
+
+	decoded, err := nameEncoding.DecodeString(strings.ToUpper(token))
+	if err != nil || len(decoded) < nameIVSize {
+		return "", errors.New("not an encrypted name")
+	}
+
+	iv := decoded[:nameIVSize]
+	segment := make([]byte, len(decoded)-nameIVSize)
+
+	n.ctr(iv).XORKeyStream(segment, decoded[nameIVSize:])
+
+	if !hmac.Equal(iv, n.iv(parent, segment)) {
+		return "", fmt.Errorf("%w: encrypted name doesn't match its parent", ErrCorrupt)
+	}
+
+	return string(segment), nil
+}
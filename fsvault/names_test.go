@@ -0,0 +1,142 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptedNames(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretKey2 = "mylongsecdddddwwwwdtmylongsecret"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v, err := Open(testRootDir, WithEncryptionKeys("key1:"+secretKey1), WithEncryptedNames(true))
+	assert.Equal(t, nil, err, "open")
+
+	assert.Equal(t, nil, v.Put("/user/23/passphrase", []byte(secretData)), "put")
+	assert.Equal(t, nil, v.Put("/user/24/passphrase", []byte(secretData)), "put")
+
+	data, err := v.Get("/user/23/passphrase")
+	assert.Equal(t, nil, err, "get")
+	assert.Equal(t, secretData, string(data), "get")
+
+	assert.Equal(t, []string{"/user/23/", "/user/24/"}, v.List("/user"), "list")
+	assert.Equal(t, []string{"/user/23/passphrase"}, v.List("/user/23"), "list")
+
+	// nothing on disk shows the key names, lock files included
+	filepath.WalkDir(testRootDir, func(path string, d fs.DirEntry, err error) error {
+		name := strings.TrimSuffix(d.Name(), ".lock")
+		assert.False(t, slices.Contains([]string{"user", "23", "24", "passphrase"}, name), path)
+		return nil
+	})
+
+	// names are deterministic, and don't depend on the primary key
+	rolled, _ := Open(testRootDir, WithEncryptionKeys("key2:"+secretKey2, "key1:"+secretKey1),
+		WithEncryptedNames(true))
+
+	data, err = rolled.Get("/user/24/passphrase")
+	assert.Equal(t, nil, err, "get after key roll")
+	assert.Equal(t, secretData, string(data), "get after key roll")
+
+	// the name key was rewrapped, so the old key is no longer needed
+	newOnly, _ := Open(testRootDir, WithEncryptionKeys("key2:"+secretKey2), WithEncryptedNames(true))
+	meta, _ := readMetadata(filepath.Join(testRootDir, metadataName))
+	assert.Equal(t, "key2", meta.Names.KeyID, "rewrapped")
+
+	report, err := rolled.Rotate(RotateOptions{})
+	assert.Equal(t, nil, err, "rotate")
+	assert.Equal(t, 1, report.Rotated, "rotate walks encrypted names")
+	assert.Equal(t, 1, report.Current, "rotated by get")
+
+	exists, _ := newOnly.KeyExists("/user/23/passphrase")
+	assert.True(t, exists, "exists")
+
+	assert.Equal(t, nil, newOnly.Delete("/user/23/passphrase"), "delete")
+	assert.Equal(t, []string{}, newOnly.List("/user/23"), "list after delete")
+
+	// a plain vault doesn't find encrypted names
+	plain, _ := Open(testRootDir, WithEncryptionKeys("key2:"+secretKey2))
+	assert.Equal(t, []string{}, plain.List("/user"), "plain list")
+}
+
+func TestEncryptedNamesErrors(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	_, err = Open(testRootDir, WithEncryptionKeys(), WithEncryptedNames(true))
+	assert.True(t, errors.Is(err, ErrEncryptionRequired), "no keys")
+
+	v, _ := Open(testRootDir, WithEncryptionKeys("eheheheheheheheheheheheheheheheh"),
+		WithEncryptedNames(true))
+
+	err = v.Put("/"+strings.Repeat("a", maxNameLength+1), []byte("data"))
+	assert.True(t, errors.Is(err, ErrInvalidKey), "long name")
+
+	err = v.Put("/"+strings.Repeat("a", maxNameLength), []byte("data"))
+	assert.Equal(t, nil, err, "longest name")
+
+	// a token moved to another directory doesn't decrypt
+	names, _ := v.nameCipher()
+	token := names.encrypt("/a", "b")
+	_, err = names.decrypt("/c", token)
+	assert.True(t, errors.Is(err, ErrCorrupt), "moved token")
+
+	segment, err := names.decrypt("/a", strings.ToUpper(token))
+	assert.Equal(t, nil, err, "case insensitive")
+	assert.Equal(t, "b", segment, "case insensitive")
+}
+
+/*
+Test package level calls share the name cipher for a vault root, rather than
+unwrapping the name key on every call.
+*/
+func TestEncryptedNamesPackageLevel(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	encryptionKeys = []string{"eheheheheheheheheheheheheheheheh"} // package vars
+	encryptNames = true
+	defer func() {
+		encryptionKeys = []string{}
+		encryptNames = false
+	}()
+
+	assert.Equal(t, nil, Put(testRootDir, "/user/23", []byte("some data")), "put")
+
+	names, err := vaultAt(testRootDir).nameCipher()
+	assert.Equal(t, nil, err, "name cipher")
+
+	again, err := vaultAt(testRootDir).nameCipher()
+	assert.Equal(t, nil, err, "name cipher")
+	assert.Same(t, names, again, "shared name cipher")
+
+	data, err := Get(testRootDir, "/user/23")
+	assert.Equal(t, nil, err, "get")
+	assert.Equal(t, "some data", string(data), "get")
+}
@@ -0,0 +1,119 @@
+package fsvault
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Values under a key prefix, such as /tenant/a, can have their own
+// keyring, so each tenant's data is encrypted with keys that no other
+// tenant's data depends on. Destroying every key in a prefix keyring makes
+// the data under the prefix unreadable, without touching anything else. A
+// prefix keyring can't be empty, as its new values would be unencrypted, so
+// give the prefix a new key in place of the destroyed ones.
+//
+// A prefix keyring works like the vault keyring: the first key encrypts new
+// data, further keys only decrypt during rollover, and Get and Rotate move
+// data to the first key. The vault keyring, and a sealed key, never decrypt
+// data under a prefix with its own keyring.
+
+// prefixKeyring is the keyring for values under prefix.
+type prefixKeyring struct {
+	prefix string // canonical, see canonicalKey()
+	keys   []encryptionKey
+}
+
+// WithPrefixKeys sets the encryption keys for values under prefix, in the
+// same forms as WithEncryptionKeys. A value uses the keyring of the longest
+// prefix it is under, or the vault keyring if none. Setting a prefix again
+// replaces its keys.
+//
+// Encrypted names use the vault keyring, see WithEncryptedNames.
+func WithPrefixKeys(prefix string, keys ...string) Option {
+	return func(v *Vault) {
+
+		keyring := prefixKeyring{prefix: canonicalKey(prefix), keys: parseKeys(keys)}
+
+		i := slices.IndexFunc(v.prefixKeys, func(p prefixKeyring) bool {
+			return p.prefix == keyring.prefix
+		})
+
+		if i < 0 {
+			v.prefixKeys = append(v.prefixKeys, keyring)
+		} else {
+			wipeKeys(v.prefixKeys[i].keys)
+			v.prefixKeys[i] = keyring
+		}
+
+		slices.SortFunc(v.prefixKeys, func(a, b prefixKeyring) int {
+			return strings.Compare(a.prefix, b.prefix)
+		})
+	}
+}
+
+// underPrefix returns true if canonical vault key is prefix, or under it.
+func underPrefix(key string, prefix string) bool {
+	return key == prefix || strings.HasPrefix(key, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// keyringPrefix returns the prefix of the keyring for vaultKey, "" for the
+// vault keyring.
+func (v *Vault) keyringPrefix(vaultKey string) string {
+
+	key := canonicalKey(vaultKey)
+	longest := ""
+
+	v.keysMu.RLock()
+	defer v.keysMu.RUnlock()
+
+	for _, p := range v.prefixKeys {
+		if underPrefix(key, p.prefix) && len(p.prefix) > len(longest) {
+			longest = p.prefix
+		}
+	}
+
+	return longest
+}
+
+// keyrings returns every keyring, the vault keyring first with prefix "",
+// then the prefix keyrings in order.
+func (v *Vault) keyrings() []prefixKeyring {
+
+	keyrings := []prefixKeyring{{keys: v.vaultKeyring()}}
+
+	v.keysMu.RLock()
+	defer v.keysMu.RUnlock()
+
+	return append(keyrings, v.prefixKeys...)
+}
+
+// hasKeys returns true if any keyring has a key.
+func (v *Vault) hasKeys() bool {
+
+	for _, keyring := range v.keyrings() {
+		if len(keyring.keys) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validatePrefixKeys returns ErrInvalidConfig if any prefix keyring is
+// empty, which would store its values unencrypted, or any prefix key can't
+// be used, see validateKeys.
+func (v *Vault) validatePrefixKeys() error {
+
+	for _, p := range v.prefixKeys {
+		if len(p.keys) == 0 {
+			return keyError("open", p.prefix,
+				fmt.Errorf("%w: prefix keyring has no keys", ErrInvalidConfig))
+		}
+		if err := validateKeys(p.keys); err != nil {
+			return keyError("open", p.prefix, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixKeys(t *testing.T) {
+
+	var (
+		vaultKey   = "eheheheheheheheheheheheheheheheh"
+		tenantKeyA = "mylongsecdddddwwwwdtmylongsecret"
+		tenantKeyB = "aaojadsnkdakndasnaddddddddddddds"
+		tenantKeyC = "cccccccccccccccccccccccccccccccc"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v, err := Open(testRootDir, WithEncryptionKeys("vault:"+vaultKey),
+		WithPrefixKeys("/tenant/a", "a1:"+tenantKeyA),
+		WithPrefixKeys("/tenant/b/", "b1:"+tenantKeyB))
+	assert.Equal(t, nil, err, "open")
+
+	v.Put("/shared", []byte(secretData))
+	v.Put("/tenant/a/user/1", []byte(secretData))
+	v.Put("/tenant/b/user/1", []byte(secretData))
+	v.Put("/tenant/ab/user/1", []byte(secretData))
+
+	assert.Equal(t, "vault", readFileData(t, testRootDir, "/shared").KeyID, "vault keyring")
+	assert.Equal(t, "a1", readFileData(t, testRootDir, "/tenant/a/user/1").KeyID, "tenant a")
+	assert.Equal(t, "b1", readFileData(t, testRootDir, "/tenant/b/user/1").KeyID, "tenant b")
+	assert.Equal(t, "vault", readFileData(t, testRootDir, "/tenant/ab/user/1").KeyID, "not a prefix")
+
+	// crypto-shredding tenant a leaves everything else readable
+	shredded, err := Open(testRootDir, WithEncryptionKeys("vault:"+vaultKey),
+		WithPrefixKeys("/tenant/a", "a2:"+tenantKeyC),
+		WithPrefixKeys("/tenant/b", "b1:"+tenantKeyB))
+	assert.Equal(t, nil, err, "open shredded")
+
+	_, err = shredded.Get("/tenant/a/user/1")
+	assert.True(t, errors.Is(err, ErrDecrypt), "shredded")
+
+	for _, key := range []string{"/shared", "/tenant/b/user/1", "/tenant/ab/user/1"} {
+		data, err := shredded.Get(key)
+		assert.Equal(t, nil, err, key)
+		assert.Equal(t, secretData, string(data), key)
+	}
+
+	// rollover within a keyring, by Get
+	rolled, _ := Open(testRootDir, WithEncryptionKeys("vault:"+vaultKey),
+		WithPrefixKeys("/tenant/a", "a1:"+tenantKeyA),
+		WithPrefixKeys("/tenant/b", "b2:"+tenantKeyC, "b1:"+tenantKeyB))
+
+	data, err := rolled.Get("/tenant/b/user/1")
+	assert.Equal(t, nil, err, "rolled get")
+	assert.Equal(t, secretData, string(data), "rolled get")
+	assert.Equal(t, "b2", readFileData(t, testRootDir, "/tenant/b/user/1").KeyID, "rolled")
+
+	// the longest prefix wins
+	nested, _ := Open(testRootDir, WithEncryptionKeys("vault:"+vaultKey),
+		WithPrefixKeys("/tenant/a", "a1:"+tenantKeyA),
+		WithPrefixKeys("/tenant/a/user", "a2:"+tenantKeyC, "a1:"+tenantKeyA),
+		WithPrefixKeys("/tenant/b", "b2:"+tenantKeyC))
+
+	report, err := nested.Rotate(RotateOptions{})
+	assert.Equal(t, nil, err, "rotate")
+	assert.Equal(t, 1, report.Rotated, "rotate")
+	assert.Equal(t, 3, report.Current, "rotate")
+	assert.Equal(t, "a2", readFileData(t, testRootDir, "/tenant/a/user/1").KeyID, "nested")
+
+	keys, err := nested.ReportKeys("")
+	assert.Equal(t, nil, err, "report")
+	assert.Equal(t, []KeyUsage{
+		{Prefix: "", KeyID: "vault", Values: []string{"/shared", "/tenant/ab/user/1"}},
+		{Prefix: "/tenant/a", KeyID: "a1"},
+		{Prefix: "/tenant/a/user", KeyID: "a2", Values: []string{"/tenant/a/user/1"}},
+		{Prefix: "/tenant/a/user", KeyID: "a1"},
+		{Prefix: "/tenant/b", KeyID: "b2", Values: []string{"/tenant/b/user/1"}},
+	}, keys.Keys, "report")
+
+	_, err = Open(testRootDir, WithPrefixKeys("/tenant/c", "short"))
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "invalid prefix key")
+
+	// an empty keyring would store values unencrypted
+	_, err = Open(testRootDir, WithEncryptionKeys("vault:"+vaultKey), WithPrefixKeys("/tenant/a"))
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "empty prefix keyring")
+}
@@ -0,0 +1,81 @@
+package fsvault
+
+import (
+	"context"
+)
+
+// KeyReport shows which encryption keys the values in a vault depend on,
+// so an old key is only removed from the keyring once nothing uses it.
+type KeyReport struct {
+	Keys          []KeyUsage // one for each key in each keyring, primary first
+	Unencrypted   []string   // vault keys of values stored without encryption
+	Undecryptable []error    // a *KeyError for each value no key can decrypt
+}
+
+// KeyUsage lists the values encrypted with a key.
+type KeyUsage struct {
+	Prefix string   // the prefix of its keyring, "" for the vault keyring
+	KeyID  string   // the id stored with the data, see parseKey
+	Values []string // vault keys of the values it encrypts
+}
+
+// ReportKeys returns the encryption keys used by each value under prefix,
+// see Vault.ReportKeys.
+func ReportKeys(vaultRoot string, prefix string) (KeyReport, error) {
+	return vaultAt(vaultRoot).ReportKeys(prefix)
+}
+
+// ReportKeys decrypts each value under prefix, "" for the whole vault, and
+// returns the keys that encrypt them, and the values that can't be
+// decrypted. Values are only read, nothing is re-encrypted.
+func (v *Vault) ReportKeys(prefix string) (KeyReport, error) {
+
+	if v.keyErr != nil {
+		return KeyReport{}, v.keyErr
+	}
+
+	if err := v.checkSealed(); err != nil {
+		return KeyReport{}, err
+	}
+
+	report := KeyReport{Keys: []KeyUsage{}}
+
+	// where each keyring starts in report.Keys
+	offsets := map[string]int{}
+
+	for _, keyring := range v.keyrings() {
+
+		offsets[keyring.prefix] = len(report.Keys)
+
+		for _, k := range keyring.keys {
+			report.Keys = append(report.Keys, KeyUsage{Prefix: keyring.prefix, KeyID: k.id})
+		}
+	}
+
+	err := v.walk(context.Background(), prefix, func(vaultKey string) {
+
+		fd, err := v.readFileData(vaultKey)
+		if err != nil {
+			report.Undecryptable = append(report.Undecryptable,
+				keyError("report", vaultKey, err))
+			return
+		}
+
+		if fd.Cipher == "" {
+			report.Unencrypted = append(report.Unencrypted, vaultKey)
+			return
+		}
+
+		_, i, err := v.decrypt(vaultKey, fd)
+		if err != nil {
+			report.Undecryptable = append(report.Undecryptable,
+				keyError("report", vaultKey, err))
+			return
+		}
+
+		i += offsets[v.keyringPrefix(vaultKey)]
+		report.Keys[i].Values = append(report.Keys[i].Values, vaultKey)
+	})
+
+	return report, err
+}
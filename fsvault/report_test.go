@@ -0,0 +1,70 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thisdougb/go-fsvault/internal/encryption"
+	"github.com/thisdougb/go-fsvault/internal/filedata"
+)
+
+func TestReportKeys(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretKey2 = "mylongsecdddddwwwwdtmylongsecret"
+		secretKey3 = "aaojadsnkdakndasnaddddddddddddds"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v1, _ := Open(testRootDir, WithEncryptionKeys("key1:"+secretKey1))
+	v1.Put("/user/1/passphrase", []byte(secretData))
+
+	v2, _ := Open(testRootDir, WithEncryptionKeys("key2:"+secretKey2, "key1:"+secretKey1))
+	v2.Put("/user/2/passphrase", []byte(secretData))
+	v2.Put("/user/3/passphrase", []byte(secretData))
+
+	// data from before key ids, found by trying each key
+	cipherData, _ := encryption.Encrypt([]byte(secretKey1), []byte(secretData))
+	writeFileData(t, testRootDir, "/legacy", &filedata.FileData{
+		Data:   cipherData,
+		Cipher: CipherAESGCM,
+	})
+
+	unencrypted, _ := Open(testRootDir, WithEncryptionKeys())
+	unencrypted.Put("/user/4/passphrase", []byte(secretData))
+
+	other, _ := Open(testRootDir, WithEncryptionKeys(secretKey3))
+	other.Put("/user/5/passphrase", []byte(secretData))
+
+	report, err := v2.ReportKeys("")
+	assert.Equal(t, nil, err, "report")
+	assert.Equal(t, []KeyUsage{
+		{KeyID: "key2", Values: []string{"/user/2/passphrase", "/user/3/passphrase"}},
+		{KeyID: "key1", Values: []string{"/legacy", "/user/1/passphrase"}},
+	}, report.Keys, "key usage")
+	assert.Equal(t, []string{"/user/4/passphrase"}, report.Unencrypted, "unencrypted")
+
+	var keyErr *KeyError
+	assert.Equal(t, 1, len(report.Undecryptable), "undecryptable")
+	assert.True(t, errors.As(report.Undecryptable[0], &keyErr), "undecryptable")
+	assert.Equal(t, "/user/5/passphrase", keyErr.Key, "undecryptable")
+	assert.True(t, errors.Is(keyErr, ErrDecrypt), "undecryptable")
+
+	// reporting changes nothing
+	assert.Equal(t, "key1", readFileData(t, testRootDir, "/user/1/passphrase").KeyID, "not rotated")
+
+	report, _ = v2.ReportKeys("/user/2")
+	assert.Equal(t, []string{"/user/2/passphrase"}, report.Keys[0].Values, "prefix")
+	assert.Equal(t, 0, len(report.Keys[1].Values), "prefix")
+}
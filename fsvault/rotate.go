@@ -0,0 +1,248 @@
+package fsvault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// Rotate re-encrypts every value that isn't using the primary key, the
+// vault cipher and the latest format, so old keys can be removed from the
+// keyring. Values without the checksum the vault writes are re-stored with
+// it, see WithUncheckedReads. Each value is rotated under its key lock and
+// written atomically, so an interrupted Rotate leaves every value readable,
+// and running it again resumes where it left off: values already rotated
+// are counted as current, without being decrypted.
+
+// RotateOptions control a Rotate.
+type RotateOptions struct {
+	Prefix      string // vault key to rotate under, "" for the whole vault
+	Concurrency int    // values rotated at once, 1 if less than 1
+	DryRun      bool   // decrypt and count values, but don't rotate them
+}
+
+// RotateReport counts the values seen by a Rotate.
+type RotateReport struct {
+	Rotated     int     // re-encrypted, or would be in a dry run
+	Current     int     // already using the primary key and vault cipher
+	Unencrypted int     // stored without encryption, and left as they are
+	Failed      int     // couldn't be read, decrypted or rotated
+	Errors      []error // a *KeyError for each failed value
+}
+
+// rotateStatus is the outcome of rotating a single value.
+type rotateStatus int
+
+const (
+	rotateFailed rotateStatus = iota
+	rotateRotated
+	rotateCurrent
+	rotateUnencrypted
+)
+
+// Rotate re-encrypts every value under opts.Prefix with the primary
+// encryption key, see Vault.Rotate.
+func Rotate(vaultRoot string, opts RotateOptions) (RotateReport, error) {
+	return vaultAt(vaultRoot).Rotate(opts)
+}
+
+// RotateContext is Rotate, but stops when ctx is done.
+func RotateContext(ctx context.Context, vaultRoot string, opts RotateOptions) (RotateReport, error) {
+	return vaultAt(vaultRoot).RotateContext(ctx, opts)
+}
+
+// Rotate re-encrypts every value under opts.Prefix that isn't using the
+// primary key, the vault cipher or the latest format. Only the data key is
+// rewrapped where possible, see Rewrap. Values that fail are counted and
+// reported, and don't stop the rotation.
+//
+// Rotate takes each key lock in turn, so the caller must not hold any.
+func (v *Vault) Rotate(opts RotateOptions) (RotateReport, error) {
+	return v.RotateContext(context.Background(), opts)
+}
+
+// RotateContext is Rotate, but stops when ctx is done, returning the
+// report so far and ctx.Err().
+func (v *Vault) RotateContext(ctx context.Context, opts RotateOptions) (RotateReport, error) {
+
+	report := RotateReport{}
+
+	if v.keyErr != nil {
+		return report, v.keyErr
+	}
+
+	if err := v.checkSealed(); err != nil {
+		return report, err
+	}
+
+	if !v.hasKeys() {
+		return report, fmt.Errorf("%w: no encryption keys", ErrEncryptionRequired)
+	}
+
+	concurrency := max(opts.Concurrency, 1)
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		keys = make(chan string)
+	)
+
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for vaultKey := range keys {
+
+				status, err := v.rotateKey(vaultKey, opts.DryRun)
+
+				mu.Lock()
+				report.add(status, err)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err := v.walk(ctx, opts.Prefix, func(vaultKey string) {
+		keys <- vaultKey
+	})
+
+	close(keys)
+	wg.Wait()
+
+	return report, err
+}
+
+// add counts a rotated value.
+func (r *RotateReport) add(status rotateStatus, err error) {
+
+	switch status {
+	case rotateRotated:
+		r.Rotated++
+	case rotateCurrent:
+		r.Current++
+	case rotateUnencrypted:
+		r.Unencrypted++
+	default:
+		r.Failed++
+		r.Errors = append(r.Errors, err)
+	}
+}
+
+// walk calls fn with the vault key of every value under prefix, in lexical
+// order, skipping vault housekeeping files.
+func (v *Vault) walk(ctx context.Context, prefix string, fn func(vaultKey string)) error {
+
+	start, err := v.fullPath(prefix)
+	if err != nil {
+		return keyError("walk", prefix, err)
+	}
+
+	err = filepath.WalkDir(start, func(fullPath string, d fs.DirEntry, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if isInternalName(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(v.root, fullPath)
+		if err != nil {
+			return err
+		}
+
+		vaultKey, err := v.vaultKeyFromDisk(rel)
+		if err != nil {
+			log.Println("fsvault.walk(): skipping", rel, err)
+			return nil
+		}
+
+		fn(vaultKey)
+
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, ctx.Err()) {
+		return keyError("walk", prefix, err)
+	}
+
+	return err
+}
+
+// rotateKey rotates the value at key, under the key lock, returning what
+// it found. In a dry run the value is decrypted, but not re-stored.
+func (v *Vault) rotateKey(vaultKey string, dryRun bool) (rotateStatus, error) {
+
+	lock, err := v.lockKeyFile(vaultKey)
+	if err != nil {
+		return rotateFailed, err
+	}
+	defer lock.Unlock()
+
+	return v.rotateLocked(vaultKey, dryRun)
+}
+
+// rotateLocked is rotateKey, for a caller holding the key lock.
+func (v *Vault) rotateLocked(vaultKey string, dryRun bool) (rotateStatus, error) {
+
+	fd, err := v.readFileData(vaultKey)
+	if err != nil {
+		return rotateFailed, keyError("rotate", vaultKey, err)
+	}
+
+	// values read without the vault's checksum get one
+	unchecked := v.checksumStale(fd)
+
+	if fd.Cipher == "" {
+		if unchecked && !dryRun {
+			err := v.writeFileData(vaultKey, fd, sameRevision(fd.Revision))
+			if err != nil && !errors.Is(err, ErrConflict) {
+				return rotateFailed, err
+			}
+		}
+		return rotateUnencrypted, nil
+	}
+
+	// no need to decrypt values already rotated, so a resumed rotation
+	// quickly skips them
+	keys := v.keyring(vaultKey)
+	if len(keys) > 0 && fd.KeyID == keys[0].id && !v.stale(fd, 0) && !unchecked {
+		return rotateCurrent, nil
+	}
+
+	data, i, err := v.decrypt(vaultKey, fd)
+	if err != nil {
+		return rotateFailed, keyError("rotate", vaultKey, err)
+	}
+
+	if !v.stale(fd, i) && !unchecked {
+		return rotateCurrent, nil
+	}
+
+	if dryRun {
+		return rotateRotated, nil
+	}
+
+	if err := v.refresh(vaultKey, fd, data); err != nil {
+		return rotateFailed, err
+	}
+
+	return rotateRotated, nil
+}
@@ -0,0 +1,117 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotate(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretKey2 = "mylongsecdddddwwwwdtmylongsecret"
+		secretKey3 = "aaojadsnkdakndasnaddddddddddddds"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v1, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	v1.Put("/user/1/passphrase", []byte(secretData))
+	v1.Put("/user/2/passphrase", []byte(secretData))
+	v1.Put("/job/1", []byte(secretData))
+
+	v2, _ := Open(testRootDir, WithEncryptionKeys(secretKey2, secretKey1))
+	v2.Put("/user/3/passphrase", []byte(secretData))
+
+	unencrypted, _ := Open(testRootDir, WithEncryptionKeys())
+	unencrypted.Put("/user/4/passphrase", []byte(secretData))
+
+	other, _ := Open(testRootDir, WithEncryptionKeys(secretKey3))
+	other.Put("/user/5/passphrase", []byte(secretData))
+
+	// a dry run changes nothing
+	before := readFileData(t, testRootDir, "/user/1/passphrase")
+	report, err := v2.Rotate(RotateOptions{Prefix: "/user", DryRun: true})
+	assert.Equal(t, nil, err, "dry run")
+	assert.Equal(t, 2, report.Rotated, "dry run rotated")
+	assert.Equal(t, 1, report.Current, "dry run current")
+	assert.Equal(t, 1, report.Unencrypted, "dry run unencrypted")
+	assert.Equal(t, 1, report.Failed, "dry run failed")
+	assert.Equal(t, before, readFileData(t, testRootDir, "/user/1/passphrase"), "dry run")
+
+	report, err = v2.Rotate(RotateOptions{Prefix: "/user", Concurrency: 4})
+	assert.Equal(t, nil, err, "rotate")
+	assert.Equal(t, 2, report.Rotated, "rotated")
+	assert.Equal(t, 1, report.Current, "current")
+	assert.Equal(t, 1, report.Unencrypted, "unencrypted")
+	assert.Equal(t, 1, report.Failed, "failed")
+
+	var keyErr *KeyError
+	assert.True(t, errors.As(report.Errors[0], &keyErr), "failure is a KeyError")
+	assert.Equal(t, "/user/5/passphrase", keyErr.Key, "failed key")
+	assert.True(t, errors.Is(keyErr, ErrDecrypt), "failed key")
+
+	// running again finds the prefix already rotated, and skips the lock
+	// files from the last run
+	report, _ = v2.Rotate(RotateOptions{Prefix: "/user"})
+	assert.Equal(t, 0, report.Rotated, "resumed rotated")
+	assert.Equal(t, 3, report.Current, "resumed current")
+
+	// the rest of the vault
+	report, _ = v2.Rotate(RotateOptions{})
+	assert.Equal(t, 1, report.Rotated, "whole vault rotated")
+
+	v3, _ := Open(testRootDir, WithEncryptionKeys(secretKey2))
+	for _, key := range []string{"/user/1/passphrase", "/user/2/passphrase", "/user/3/passphrase", "/job/1"} {
+		data, err := v3.Get(key)
+		assert.Equal(t, nil, err, key)
+		assert.Equal(t, secretData, string(data), key)
+	}
+}
+
+func TestRotateErrors(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v, _ := Open(testRootDir, WithEncryptionKeys("eheheheheheheheheheheheheheheheh"))
+	v.Put("/key", []byte("data"))
+
+	_, err = v.Rotate(RotateOptions{Prefix: "/missing"})
+	assert.True(t, errors.Is(err, ErrNotFound), "missing prefix")
+
+	_, err = v.Rotate(RotateOptions{Prefix: "/../etc"})
+	assert.True(t, errors.Is(err, ErrInvalidKey), "invalid prefix")
+
+	plain, _ := Open(testRootDir, WithEncryptionKeys())
+	_, err = plain.Rotate(RotateOptions{})
+	assert.True(t, errors.Is(err, ErrEncryptionRequired), "no keys")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = v.RotateContext(ctx, RotateOptions{})
+	assert.True(t, errors.Is(err, context.Canceled), "cancelled")
+
+	// a corrupt file fails, but doesn't stop the rotation
+	os.WriteFile(filepath.Join(testRootDir, "corrupt"), []byte("{"), 0644)
+	report, err := v.Rotate(RotateOptions{})
+	assert.Equal(t, nil, err, "corrupt file")
+	assert.Equal(t, 1, report.Failed, "corrupt file")
+	assert.Equal(t, 1, report.Current, "corrupt file")
+	assert.True(t, errors.Is(report.Errors[0], ErrCorrupt), "corrupt file")
+}
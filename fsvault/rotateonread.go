@@ -0,0 +1,124 @@
+package fsvault
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/thisdougb/go-fsvault/internal/filedata"
+)
+
+// RotateOnRead is what Get does with a value that isn't using the primary
+// key, the vault cipher or the latest format.
+type RotateOnRead int
+
+const (
+	// RotateOnReadLazy re-stores the value without taking the key lock, so
+	// it can race another writer. This is the default.
+	RotateOnReadLazy RotateOnRead = iota
+	// RotateOnReadLocked re-stores the value under the key lock, if the
+	// lock is free. A value read while its lock is held, such as with
+	// GetWithLock, is left for a later read or Rotate.
+	RotateOnReadLocked
+	// RotateOnReadNever leaves the value as it is, so a read never writes.
+	// Use Rotate to re-encrypt values, and the stale key hook to find them.
+	RotateOnReadNever
+)
+
+// Names of the RotateOnRead policies, for FSVAULT_ROTATE_ON_READ.
+var rotateOnReadNames = map[string]RotateOnRead{
+	"lazy":   RotateOnReadLazy,
+	"locked": RotateOnReadLocked,
+	"never":  RotateOnReadNever,
+}
+
+// StaleKey describes a value Get found using an old key, cipher or format.
+type StaleKey struct {
+	Key     string // vault key of the value
+	KeyID   string // id of the key that decrypted it
+	Cipher  string // cipher that encrypted it
+	Version int    // format version it is stored in
+}
+
+// staleKeyHook is the package level stale key hook, see SetStaleKeyHook.
+var staleKeyHook func(StaleKey)
+
+// WithRotateOnRead sets what Get does with values that aren't using the
+// primary key. The default is set by FSVAULT_ROTATE_ON_READ.
+func WithRotateOnRead(policy RotateOnRead) Option {
+	return func(v *Vault) {
+		v.rotateOnRead = policy
+	}
+}
+
+// WithStaleKeyHook sets fn to be called by Get with each value it reads
+// that isn't using the primary key, before any rotation. It is called on
+// the reading goroutine, so must be quick, and must not use the key.
+func WithStaleKeyHook(fn func(StaleKey)) Option {
+	return func(v *Vault) {
+		v.staleHook = fn
+	}
+}
+
+// SetStaleKeyHook sets the stale key hook for the package level functions,
+// see WithStaleKeyHook.
+func SetStaleKeyHook(fn func(StaleKey)) {
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	staleKeyHook = fn
+}
+
+// parseRotateOnRead returns the policy called name.
+func parseRotateOnRead(name string) (RotateOnRead, error) {
+
+	policy, ok := rotateOnReadNames[name]
+	if !ok {
+		return RotateOnReadLazy, fmt.Errorf("%w: unknown rotate on read policy %q",
+			ErrInvalidConfig, name)
+	}
+
+	return policy, nil
+}
+
+// staleRead calls the stale key hook for fd, read from vaultKey and
+// decrypted to data with keyID, then rotates it by the rotate on read
+// policy. Rotation failures are logged, the read still succeeds.
+func (v *Vault) staleRead(vaultKey string, fd *filedata.FileData, keyID string, data []byte) {
+
+	if v.staleHook != nil {
+		v.staleHook(StaleKey{
+			Key:     vaultKey,
+			KeyID:   keyID,
+			Cipher:  fd.Cipher,
+			Version: fd.Version,
+		})
+	}
+
+	switch v.rotateOnRead {
+	case RotateOnReadNever:
+		return
+
+	case RotateOnReadLocked:
+		lock, ok := v.tryLock(vaultKey, false)
+		if !ok {
+			log.Println("fsvault.Get(): key is locked, not rolling encryption for data at key", vaultKey)
+			return
+		}
+		defer lock.Unlock()
+
+		log.Println("fsvault.Get(): rolling encryption for data at key", vaultKey)
+
+		// the data may have changed since it was read, so read it again
+		if _, err := v.rotateLocked(vaultKey, false); err != nil {
+			log.Println("fsvault.Get(): failed data refresh at key", vaultKey)
+		}
+
+	default:
+		log.Println("fsvault.Get(): rolling encryption for data at key", vaultKey)
+
+		if err := v.refresh(vaultKey, fd, data); err != nil {
+			log.Println("fsvault.Get(): failed data refresh at key", vaultKey)
+		}
+	}
+}
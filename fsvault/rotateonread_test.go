@@ -0,0 +1,112 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotateOnRead(t *testing.T) {
+
+	var (
+		secretKey1 = "key1:eheheheheheheheheheheheheheheheh"
+		secretKey2 = "key2:mylongsecdddddwwwwdtmylongsecret"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	old, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	for _, key := range []string{"/lazy", "/locked", "/held", "/never"} {
+		old.Put(key, []byte(secretData))
+	}
+
+	testCases := []struct {
+		description string
+		policy      RotateOnRead
+		vaultKey    string
+		holdLock    bool
+		expectKeyID string
+	}{
+		{
+			description: "lazy",
+			policy:      RotateOnReadLazy,
+			vaultKey:    "/lazy",
+			expectKeyID: "key2",
+		},
+		{
+			description: "locked",
+			policy:      RotateOnReadLocked,
+			vaultKey:    "/locked",
+			expectKeyID: "key2",
+		},
+		{
+			description: "locked while the lock is held",
+			policy:      RotateOnReadLocked,
+			vaultKey:    "/held",
+			holdLock:    true,
+			expectKeyID: "key1",
+		},
+		{
+			description: "never",
+			policy:      RotateOnReadNever,
+			vaultKey:    "/never",
+			expectKeyID: "key1",
+		},
+	}
+
+	for _, tc := range testCases {
+
+		stale := []StaleKey{}
+
+		v, _ := Open(testRootDir, WithEncryptionKeys(secretKey2, secretKey1),
+			WithRotateOnRead(tc.policy),
+			WithStaleKeyHook(func(s StaleKey) {
+				stale = append(stale, s)
+			}))
+
+		var data []byte
+		if tc.holdLock {
+			var lock Unlocker
+			lock, data, err = v.GetWithLock(tc.vaultKey)
+			lock.Unlock()
+		} else {
+			data, err = v.Get(tc.vaultKey)
+		}
+
+		assert.Equal(t, nil, err, tc.description)
+		assert.Equal(t, secretData, string(data), tc.description)
+		assert.Equal(t, tc.expectKeyID, readFileData(t, testRootDir, tc.vaultKey).KeyID, tc.description)
+
+		assert.Equal(t, []StaleKey{{
+			Key:     tc.vaultKey,
+			KeyID:   "key1",
+			Cipher:  CipherAESGCM,
+			Version: formatVersion,
+		}}, stale, tc.description)
+	}
+
+	// a read only vault never writes
+	if os.Getuid() != 0 {
+		os.Chmod(testRootDir, 0555)
+		defer os.Chmod(testRootDir, 0755)
+
+		v, _ := Open(testRootDir, WithEncryptionKeys(secretKey2, secretKey1),
+			WithRotateOnRead(RotateOnReadNever))
+
+		data, err := v.Get("/never")
+		assert.Equal(t, nil, err, "read only")
+		assert.Equal(t, secretData, string(data), "read only")
+	}
+
+	_, err = parseRotateOnRead("sometimes")
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "unknown policy")
+}
@@ -0,0 +1,350 @@
+package fsvault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/thisdougb/go-fsvault/internal/securemem"
+	"github.com/thisdougb/go-fsvault/internal/shamir"
+)
+
+// A sealed vault has a primary key that nobody holds. InitSeal splits a new
+// random key into shares, using Shamir's secret sharing, to hand out to
+// different people. The vault refuses to read or write data until enough
+// shares have been given to Unseal to rebuild the key, which then becomes
+// the primary key. Only a fingerprint of the key is stored, in a seal file
+// at the vault root, to check the rebuilt key.
+//
+// Keys from the environment, or WithEncryptionKeys, are kept as older keys
+// so existing data can still be read, and rotated to the sealed key.
+
+// sealName is the vault seal file, at the vault root.
+const sealName = internalPrefix + "seal"
+
+// sealKeySize is the length of the sealed key.
+const sealKeySize = 32
+
+// sealConfig is the content of the seal file.
+type sealConfig struct {
+	Shares    int    `json:"shares"`
+	Threshold int    `json:"threshold"`
+	KeyID     string `json:"keyid"`
+}
+
+// unsealState collects shares until the sealed key can be rebuilt.
+type unsealState struct {
+	mu     sync.Mutex
+	config sealConfig
+	shares [][]byte
+	key    *encryptionKey // nil while sealed
+}
+
+// unsealStates are shared by the package level functions, by vault root,
+// so Unseal is only needed once per process. A vault that isn't sealed has
+// a nil state, so its seal file is only looked for once. A vault sealed by
+// another process is seen by package level calls after a restart.
+var (
+	unsealStates   = map[string]*unsealState{}
+	unsealStatesMu sync.Mutex
+)
+
+// InitSeal seals the vault at vaultRoot, see Vault.InitSeal.
+func InitSeal(vaultRoot string, shares int, threshold int) ([]string, error) {
+	return vaultAt(vaultRoot).InitSeal(shares, threshold)
+}
+
+// Unseal adds a share towards unsealing the vault at vaultRoot, see
+// Vault.Unseal. Once unsealed, all package level calls for vaultRoot can
+// read and write data.
+func Unseal(vaultRoot string, share string) (bool, error) {
+	return vaultAt(vaultRoot).Unseal(share)
+}
+
+// Sealed returns true if the vault at vaultRoot is sealed, and not yet
+// unsealed by this process.
+func Sealed(vaultRoot string) bool {
+	return vaultAt(vaultRoot).Sealed()
+}
+
+// InitSeal seals the vault with a new random primary key, split into
+// shares, any threshold of which unseal the vault. The shares are only
+// returned here, and must be kept safe. A vault can only be sealed once.
+//
+// The vault is sealed when it is next opened, v itself is unchanged. The
+// package level functions are sealed straight away.
+func (v *Vault) InitSeal(shares int, threshold int) ([]string, error) {
+
+	secret := make([]byte, sealKeySize)
+	defer clear(secret)
+
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	parts, err := shamir.Split(secret, shares, threshold)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	config := sealConfig{
+		Shares:    shares,
+		Threshold: threshold,
+		KeyID:     keyFingerprint(secret),
+	}
+
+	configJSON, _ := json.Marshal(config)
+
+	if err := os.MkdirAll(v.root, v.dirPerm); err != nil {
+		return nil, err
+	}
+
+	err = writeFileExclusive(filepath.Join(v.root, sealName), configJSON,
+		v.filePerm, v.durability)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("vault is already sealed: %w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// package level calls are sealed from now on
+	if v.shared {
+		unsealStatesMu.Lock()
+		delete(unsealStates, filepath.Clean(v.root))
+		unsealStatesMu.Unlock()
+	}
+
+	encoded := make([]string, len(parts))
+	for i, part := range parts {
+		encoded[i] = base64.StdEncoding.EncodeToString(part)
+	}
+
+	return encoded, nil
+}
+
+// Unseal adds a share towards unsealing the vault, and returns true once
+// the vault is unsealed. Until enough shares are given it returns false,
+// and reads and writes return ErrSealed. Shares that don't rebuild the
+// sealed key return ErrInvalidShare, and unsealing starts again.
+//
+// A vault that isn't sealed is always unsealed.
+func (v *Vault) Unseal(share string) (bool, error) {
+
+	if v.unseal == nil {
+		return true, nil
+	}
+
+	return v.unseal.add(share)
+}
+
+// Sealed returns true if the vault is sealed, and not yet unsealed.
+func (v *Vault) Sealed() bool {
+	return v.checkSealed() != nil
+}
+
+// checkSealed returns ErrSealed if the vault is sealed.
+func (v *Vault) checkSealed() error {
+
+	if v.unseal != nil && v.unseal.unsealedKey() == nil {
+		return ErrSealed
+	}
+
+	return nil
+}
+
+// keyring returns the encryption keys for vaultKey, primary first. These
+// are the keys of its prefix keyring, see WithPrefixKeys, or the vault keys.
+func (v *Vault) keyring(vaultKey string) []encryptionKey {
+
+	prefix := v.keyringPrefix(vaultKey)
+	if prefix == "" {
+		return v.vaultKeyring()
+	}
+
+	v.keysMu.RLock()
+	defer v.keysMu.RUnlock()
+
+	for _, p := range v.prefixKeys {
+		if p.prefix == prefix {
+			return p.keys
+		}
+	}
+
+	return nil
+}
+
+// vaultKeyring returns the vault encryption keys, primary first, including
+// the sealed key once unsealed.
+func (v *Vault) vaultKeyring() []encryptionKey {
+
+	v.keysMu.RLock()
+	keys := v.keys
+	v.keysMu.RUnlock()
+
+	if v.unseal == nil {
+		return keys
+	}
+
+	key := v.unseal.unsealedKey()
+	if key == nil {
+		return nil
+	}
+
+	return append([]encryptionKey{*key}, keys...)
+}
+
+// loadSeal sets up unsealing if the vault is sealed.
+func (v *Vault) loadSeal() error {
+
+	config, err := readSealConfig(v.root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	v.unseal = &unsealState{config: *config}
+
+	return nil
+}
+
+// sharedUnsealState returns the unseal state shared by package level calls
+// for vaultRoot, or nil if the vault isn't sealed.
+func sharedUnsealState(vaultRoot string) (*unsealState, error) {
+
+	root := filepath.Clean(vaultRoot)
+
+	unsealStatesMu.Lock()
+	state, ok := unsealStates[root]
+	unsealStatesMu.Unlock()
+
+	if ok {
+		return state, nil
+	}
+
+	config, err := readSealConfig(root)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	unsealStatesMu.Lock()
+	defer unsealStatesMu.Unlock()
+
+	// another goroutine may have got here first
+	if state, ok := unsealStates[root]; ok {
+		return state, nil
+	}
+
+	if config != nil {
+		state = &unsealState{config: *config}
+	}
+	unsealStates[root] = state
+
+	return state, nil
+}
+
+// readSealConfig reads the seal file in the vault at root.
+func readSealConfig(root string) (*sealConfig, error) {
+
+	content, err := os.ReadFile(filepath.Join(root, sealName))
+	if err != nil {
+		return nil, err
+	}
+
+	config := &sealConfig{}
+
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("%w: vault seal: %w", ErrCorrupt, err)
+	}
+
+	return config, nil
+}
+
+// add adds an encoded share, returning true once the key is rebuilt.
+func (s *unsealState) add(share string) (bool, error) {
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(share))
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrInvalidShare, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.key != nil {
+		clear(decoded)
+		return true, nil
+	}
+
+	// the same share given twice doesn't count twice
+	for _, existing := range s.shares {
+		if bytes.Equal(existing, decoded) {
+			clear(decoded)
+			return false, nil
+		}
+	}
+
+	s.shares = append(s.shares, decoded)
+	if len(s.shares) < s.config.Threshold {
+		return false, nil
+	}
+
+	secret, err := shamir.Combine(s.shares)
+	s.wipeShares()
+
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrInvalidShare, err)
+	}
+
+	if keyFingerprint(secret) != s.config.KeyID {
+		clear(secret)
+		return false, fmt.Errorf("%w: shares don't match the sealed key", ErrInvalidShare)
+	}
+
+	s.key = &encryptionKey{id: s.config.KeyID, secret: securemem.Move(secret)}
+
+	return true, nil
+}
+
+// unsealedKey returns the sealed key, or nil while still sealed.
+func (s *unsealState) unsealedKey() *encryptionKey {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.key
+}
+
+// wipeShares zeroes and drops the shares collected so far.
+func (s *unsealState) wipeShares() {
+
+	for _, share := range s.shares {
+		clear(share)
+	}
+
+	s.shares = nil
+}
+
+// reseal wipes the sealed key, and any shares collected towards it.
+func (s *unsealState) reseal() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.wipeShares()
+
+	if s.key != nil {
+		s.key.secret.Wipe()
+		s.key = nil
+	}
+}
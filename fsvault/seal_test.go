@@ -0,0 +1,148 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeal(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	// data from before the vault was sealed
+	v1, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	v1.Put("/old", []byte(secretData))
+
+	shares, err := v1.InitSeal(5, 3)
+	assert.Equal(t, nil, err, "init seal")
+	assert.Equal(t, 5, len(shares), "init seal")
+
+	_, err = v1.InitSeal(5, 3)
+	assert.NotEqual(t, nil, err, "already sealed")
+
+	v2, err := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	assert.Equal(t, nil, err, "open sealed")
+	assert.True(t, v2.Sealed(), "open sealed")
+
+	_, err = v2.Get("/old")
+	assert.True(t, errors.Is(err, ErrSealed), "sealed get")
+	err = v2.Put("/new", []byte(secretData))
+	assert.True(t, errors.Is(err, ErrSealed), "sealed put")
+	_, err = v2.Rotate(RotateOptions{})
+	assert.True(t, errors.Is(err, ErrSealed), "sealed rotate")
+
+	// repeating a share doesn't count
+	for _, share := range []string{shares[4], shares[4], shares[1]} {
+		unsealed, err := v2.Unseal(share)
+		assert.Equal(t, nil, err, "unseal")
+		assert.False(t, unsealed, "unseal below threshold")
+	}
+
+	unsealed, err := v2.Unseal(shares[2])
+	assert.Equal(t, nil, err, "unseal")
+	assert.True(t, unsealed, "unseal at threshold")
+	assert.False(t, v2.Sealed(), "unsealed")
+
+	// old data is read with the old key, and moves to the sealed key
+	data, err := v2.Get("/old")
+	assert.Equal(t, nil, err, "unsealed get")
+	assert.Equal(t, secretData, string(data), "unsealed get")
+	assert.Equal(t, v2.vaultKeyring()[0].id, readFileData(t, testRootDir, "/old").KeyID, "sealed key")
+
+	assert.Equal(t, nil, v2.Put("/new", []byte(secretData)), "unsealed put")
+
+	// without the sealed key the data can't be read, even with the old key
+	v3, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	v3.unseal = nil
+	_, err = v3.Get("/new")
+	assert.True(t, errors.Is(err, ErrDecrypt), "without sealed key")
+
+	// shares from different seals don't rebuild the key
+	otherRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(otherRootDir) // clean up
+
+	otherShares, _ := InitSeal(otherRootDir, 3, 2)
+
+	v4, _ := Open(testRootDir)
+	v4.Unseal(shares[0])
+	v4.Unseal(shares[1])
+	unsealed, err = v4.Unseal(otherShares[0])
+	assert.True(t, errors.Is(err, ErrInvalidShare), "wrong shares")
+	assert.False(t, unsealed, "wrong shares")
+
+	_, err = v4.Unseal("not base64!")
+	assert.True(t, errors.Is(err, ErrInvalidShare), "invalid share")
+
+	// package level calls share the unsealed state
+	_, err = Get(otherRootDir, "/key")
+	assert.True(t, errors.Is(err, ErrSealed), "package level sealed")
+	assert.True(t, Sealed(otherRootDir), "package level sealed")
+
+	Unseal(otherRootDir, otherShares[2])
+	unsealed, _ = Unseal(otherRootDir, otherShares[0])
+	assert.True(t, unsealed, "package level unseal")
+	assert.Equal(t, nil, Put(otherRootDir, "/key", []byte(secretData)), "package level put")
+	data, err = Get(otherRootDir, "/key")
+	assert.Equal(t, nil, err, "package level get")
+	assert.Equal(t, secretData, string(data), "package level get")
+}
+
+func TestInitSealErrors(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	_, err = InitSeal(testRootDir, 2, 3)
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "threshold above shares")
+
+	_, err = InitSeal(testRootDir, 3, 1)
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "threshold of 1")
+
+	assert.False(t, Sealed(testRootDir), "not sealed")
+}
+
+/*
+Test package level calls look for the seal file once, until a package level
+InitSeal seals the vault.
+*/
+func TestSealCachedState(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	assert.Equal(t, nil, Put(testRootDir, "/key", []byte("some data")), "put")
+
+	unsealStatesMu.Lock()
+	state, ok := unsealStates[filepath.Clean(testRootDir)]
+	unsealStatesMu.Unlock()
+	assert.True(t, ok, "not sealed is cached")
+	assert.Nil(t, state, "not sealed is cached")
+
+	_, err = InitSeal(testRootDir, 3, 2)
+	assert.Equal(t, nil, err, "init seal")
+	assert.True(t, Sealed(testRootDir), "sealed straight away")
+}
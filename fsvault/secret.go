@@ -0,0 +1,214 @@
+package fsvault
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"github.com/thisdougb/go-fsvault/internal/securemem"
+)
+
+// Encryption keys, and other key material, are held in buffers on memory
+// pages of their own, locked into memory where the platform allows, that
+// are zeroed when no longer needed. Data keys are zeroed after each use,
+// GetSecret zeroes the plaintext after its callback, and Close zeroes the
+// keys.
+//
+// Keys given as strings, such as FSVAULT_SECRET_KEYS or the arguments to
+// WithEncryptionKeys, are copied into buffers, but the strings themselves
+// can't be wiped.
+
+// sharedKeyring caches the package level keys parsed into buffers, so each
+// package level call doesn't copy them again. Keyed by the key string.
+//
+// Keys a new configuration no longer uses are dropped from this cache, and
+// the other caches of key material, see dropUnusedKeys. Package level calls
+// still running may be using them, so they are wiped when garbage
+// collected, or straight away by the package level Close.
+var (
+	sharedKeyring   = map[string]encryptionKey{}
+	sharedKeyringMu sync.Mutex
+)
+
+// GetSecret calls fn with the data at key, see Vault.GetSecret.
+func GetSecret(vaultRoot string, vaultKey string, fn func(data []byte) error) error {
+	return vaultAt(vaultRoot).GetSecret(vaultKey, fn)
+}
+
+// GetSecret calls fn with the data at key, and zeroes the data when fn
+// returns, returning the error from fn. The data is only valid during fn,
+// which must copy anything it keeps. Otherwise it is the same as Get.
+func (v *Vault) GetSecret(vaultKey string, fn func(data []byte) error) error {
+
+	data, _, err := v.get(vaultKey)
+	if err != nil {
+		return err
+	}
+
+	secret := securemem.Move(data)
+	defer secret.Wipe()
+
+	return fn(secret.Bytes())
+}
+
+// Close zeroes the vault's key material, after which any operation that
+// needs a key returns ErrClosed. A sealed vault is sealed again. Close must
+// not be called while the vault is in use, and it always returns nil.
+func (v *Vault) Close() error {
+
+	v.keyErr = ErrClosed
+
+	if v.shared {
+		return nil
+	}
+
+	for _, keyring := range v.keyrings() {
+		wipeKeys(keyring.keys)
+	}
+
+	wipeIntegrityKey(v.integrityKey)
+
+	if v.unseal != nil {
+		v.unseal.reseal()
+	}
+
+	v.namesMu.Lock()
+	defer v.namesMu.Unlock()
+
+	if v.names != nil {
+		v.names.wipe()
+		v.names = nil
+	}
+
+	return nil
+}
+
+// wipeKeys zeroes the secrets of keys.
+func wipeKeys(keys []encryptionKey) {
+	for _, k := range keys {
+		k.secret.Wipe()
+	}
+}
+
+// wipeIntegrityKey zeroes the secret of k, if there is one.
+func wipeIntegrityKey(k *encryptionKey) {
+	if k != nil {
+		k.secret.Wipe()
+	}
+}
+
+// Close wipes the package level keys, and the key material cached for the
+// package level functions, and seals again the vaults they unsealed. Until
+// Configure or LoadKeys is called again, package level calls return
+// ErrClosed. Call it once nothing is using the package level functions,
+// e.g. at shutdown, as calls still running may fail.
+func Close() error {
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	configErr = ErrClosed
+
+	sharedKeyringMu.Lock()
+	for key, k := range sharedKeyring {
+		k.secret.Wipe()
+		delete(sharedKeyring, key)
+	}
+	sharedKeyringMu.Unlock()
+
+	derivedKeysMu.Lock()
+	for cacheKey, derived := range derivedKeys {
+		derived.secret.Wipe()
+		delete(derivedKeys, cacheKey)
+	}
+	derivedKeysMu.Unlock()
+
+	sharedNamesMu.Lock()
+	for root, names := range sharedNames {
+		names.wipe()
+		delete(sharedNames, root)
+	}
+	sharedNamesMu.Unlock()
+
+	unsealStatesMu.Lock()
+	for root, state := range unsealStates {
+		if state != nil {
+			state.reseal()
+		}
+		delete(unsealStates, root)
+	}
+	unsealStatesMu.Unlock()
+
+	return nil
+}
+
+// dropUnusedKeys drops the cached key material the package level config
+// no longer uses, after Configure or LoadKeys. Name ciphers are dropped
+// whatever changed, so they are unwrapped again with the new keys. The
+// caller must hold configMu.
+func dropUnusedKeys() {
+
+	inUse := map[string]bool{integrityKey: true}
+	for _, key := range encryptionKeys {
+		inUse[key] = true
+	}
+
+	passphrases := map[[sha256.Size]byte]bool{}
+
+	sharedKeyringMu.Lock()
+	for key, k := range sharedKeyring {
+		if !inUse[key] {
+			delete(sharedKeyring, key)
+		} else if k.passphrase != "" {
+			passphrases[sha256.Sum256([]byte(k.passphrase))] = true
+		}
+	}
+	sharedKeyringMu.Unlock()
+
+	derivedKeysMu.Lock()
+	for cacheKey, derived := range derivedKeys {
+		if !passphrases[derived.passphrase] {
+			delete(derivedKeys, cacheKey)
+		}
+	}
+	derivedKeysMu.Unlock()
+
+	sharedNamesMu.Lock()
+	clear(sharedNames)
+	sharedNamesMu.Unlock()
+}
+
+// sharedKeys returns the package level keys, sharing the buffers of
+// earlier calls. The slice is new, so deriveKeys can replace keys in it.
+func sharedKeys(keys []string) []encryptionKey {
+
+	sharedKeyringMu.Lock()
+	defer sharedKeyringMu.Unlock()
+
+	parsed := make([]encryptionKey, 0, len(keys))
+
+	for _, key := range keys {
+
+		k, ok := sharedKeyring[key]
+		if !ok {
+			k = parseKey(key)
+			sharedKeyring[key] = k
+		}
+
+		parsed = append(parsed, k)
+	}
+
+	return parsed
+}
+
+// sharedIntegrityKey returns the package level integrity key, sharing the
+// buffer of earlier calls, or nil for "".
+func sharedIntegrityKey(key string) *encryptionKey {
+
+	if key == "" {
+		return nil
+	}
+
+	k := sharedKeys([]string{key})[0]
+
+	return &k
+}
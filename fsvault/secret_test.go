@@ -0,0 +1,273 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thisdougb/go-fsvault/internal/securemem"
+)
+
+func TestGetSecret(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	encrypted, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	encrypted.Put("/encrypted", []byte(secretData))
+
+	plain, _ := Open(testRootDir, WithEncryptionKeys())
+	plain.Put("/plain", []byte(secretData))
+
+	for _, key := range []string{"/encrypted", "/plain"} {
+
+		var kept []byte
+
+		err = encrypted.GetSecret(key, func(data []byte) error {
+			assert.Equal(t, secretData, string(data), key)
+			kept = data
+			return nil
+		})
+		assert.Equal(t, nil, err, key)
+		assert.Equal(t, make([]byte, len(secretData)), kept, "wiped after the callback")
+	}
+
+	errCallback := errors.New("callback failed")
+	err = encrypted.GetSecret("/encrypted", func(data []byte) error {
+		return errCallback
+	})
+	assert.True(t, errors.Is(err, errCallback), "callback error")
+
+	err = encrypted.GetSecret("/missing", func(data []byte) error {
+		assert.Fail(t, "called for a missing key")
+		return nil
+	})
+	assert.True(t, errors.Is(err, ErrNotFound), "missing key")
+}
+
+func TestClose(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretKey2 = "mylongsecdddddwwwwdtmylongsecret"
+		secretData = "some super secret data"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v, _ := Open(testRootDir, WithEncryptionKeys(secretKey1),
+		WithPrefixKeys("/tenant", secretKey2),
+		WithIntegrityKey(secretKey2),
+		WithEncryptedNames(true))
+
+	v.Put("/key", []byte(secretData))
+
+	secret := v.keys[0].secret.Bytes()
+	tenantSecret := v.prefixKeys[0].keys[0].secret.Bytes()
+
+	assert.Equal(t, nil, v.Close(), "close")
+
+	assert.Equal(t, make([]byte, len(secretKey1)), secret, "key wiped")
+	assert.Equal(t, make([]byte, len(secretKey2)), tenantSecret, "prefix key wiped")
+	assert.Nil(t, v.integrityKey.secret.Bytes(), "integrity key wiped")
+	assert.Nil(t, v.names, "name key wiped")
+
+	_, err = v.Get("/key")
+	assert.True(t, errors.Is(err, ErrClosed), "get after close")
+	err = v.Put("/key", []byte(secretData))
+	assert.True(t, errors.Is(err, ErrClosed), "put after close")
+
+	// the data is untouched
+	reopened, _ := Open(testRootDir, WithEncryptionKeys(secretKey1),
+		WithIntegrityKey(secretKey2), WithEncryptedNames(true))
+
+	data, err := reopened.Get("/key")
+	assert.Equal(t, nil, err, "reopened")
+	assert.Equal(t, secretData, string(data), "reopened")
+
+	// closing a sealed vault seals it again
+	shares, _ := reopened.InitSeal(3, 2)
+
+	sealed, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	sealed.Unseal(shares[0])
+	sealed.Unseal(shares[1])
+	assert.False(t, sealed.Sealed(), "unsealed")
+
+	sealed.Close()
+	assert.True(t, sealed.Sealed(), "sealed after close")
+}
+
+func TestCloseReplacedKeys(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretKey2 = "mylongsecdddddwwwwdtmylongsecret"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	keep := func(secret **securemem.Buffer) Option {
+		return func(v *Vault) {
+			*secret = v.keys[0].secret
+		}
+	}
+
+	// keys replaced by a later option are wiped
+	var replaced *securemem.Buffer
+	v, err := Open(testRootDir, WithEncryptionKeys(secretKey1), keep(&replaced),
+		WithEncryptionKeys(secretKey2))
+	assert.Equal(t, nil, err, "open")
+	assert.Nil(t, replaced.Bytes(), "replaced key wiped")
+	assert.Equal(t, secretKey2, string(v.keys[0].secret.Bytes()), "new key")
+
+	// keys of a vault that fails to open are wiped
+	var failed *securemem.Buffer
+	_, err = Open(testRootDir, WithEncryptionKeys(secretKey1), keep(&failed),
+		WithIntegrityKey("tooshort"))
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "open")
+	assert.Nil(t, failed.Bytes(), "key wiped")
+}
+
+func TestSharedKeyBuffers(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretKey2 = "mylongsecdddddwwwwdtmylongsecret"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	// restore the package level config
+	defer func() {
+		os.Unsetenv("FSVAULT_SECRET_KEYS")
+		os.Unsetenv("FSVAULT_INTEGRITY_KEY")
+		Configure()
+	}()
+
+	os.Setenv("FSVAULT_SECRET_KEYS", secretKey1)
+	os.Setenv("FSVAULT_INTEGRITY_KEY", secretKey2)
+	assert.Equal(t, nil, Configure(), "configure")
+
+	// the keys checked by Configure are the ones package level calls use
+	sharedKeyringMu.Lock()
+	key, integrity := sharedKeyring[secretKey1], sharedKeyring[secretKey2]
+	sharedKeyringMu.Unlock()
+
+	v := vaultAt(testRootDir)
+	assert.Same(t, key.secret, v.keys[0].secret, "key")
+	assert.Same(t, integrity.secret, v.integrityKey.secret, "integrity key")
+
+	// closing a package level vault leaves the shared buffers alone
+	v.Close()
+	assert.Equal(t, secretKey1, string(key.secret.Bytes()), "key")
+	assert.Equal(t, secretKey2, string(integrity.secret.Bytes()), "integrity key")
+	assert.Equal(t, nil, Put(testRootDir, "/key", []byte("data")), "put")
+}
+
+func TestSharedKeysDropped(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretKey2 = "mylongsecdddddwwwwdtmylongsecret"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	// restore the package level config
+	defer func() {
+		os.Unsetenv("FSVAULT_SECRET_KEYS")
+		Configure()
+	}()
+
+	os.Setenv("FSVAULT_SECRET_KEYS", secretKey1)
+	assert.Equal(t, nil, Configure(), "configure")
+	assert.Equal(t, nil, Put(testRootDir, "/key", []byte("data")), "put")
+
+	// keys a new config doesn't use are dropped from the cache
+	os.Setenv("FSVAULT_SECRET_KEYS", secretKey2+","+secretKey1)
+	assert.Equal(t, nil, Configure(), "configure")
+
+	sharedKeyringMu.Lock()
+	_, cached := sharedKeyring[secretKey1]
+	sharedKeyringMu.Unlock()
+	assert.True(t, cached, "key still in use")
+
+	os.Setenv("FSVAULT_SECRET_KEYS", secretKey2)
+	assert.Equal(t, nil, Configure(), "configure")
+
+	sharedKeyringMu.Lock()
+	_, cached = sharedKeyring[secretKey1]
+	sharedKeyringMu.Unlock()
+	assert.False(t, cached, "key dropped")
+}
+
+func TestPackageClose(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	// restore the package level config
+	defer func() {
+		os.Unsetenv("FSVAULT_SECRET_KEYS")
+		Configure()
+	}()
+
+	os.Setenv("FSVAULT_SECRET_KEYS", secretKey1)
+	assert.Equal(t, nil, Configure(), "configure")
+	assert.Equal(t, nil, Put(testRootDir, "/key", []byte("data")), "put")
+
+	sharedKeyringMu.Lock()
+	key := sharedKeyring[secretKey1]
+	sharedKeyringMu.Unlock()
+
+	// Close wipes the cached keys, and package level calls then fail
+	assert.Equal(t, nil, Close(), "close")
+	assert.Nil(t, key.secret.Bytes(), "key wiped")
+
+	err = Put(testRootDir, "/key", []byte("data"))
+	assert.True(t, errors.Is(err, ErrClosed), "put after close")
+
+	sharedKeyringMu.Lock()
+	assert.Equal(t, 0, len(sharedKeyring), "cache stays empty")
+	sharedKeyringMu.Unlock()
+
+	// Configure sets the package up again
+	assert.Equal(t, nil, Configure(), "configure")
+	data, err := Get(testRootDir, "/key")
+	assert.Equal(t, nil, err, "get")
+	assert.Equal(t, "data", string(data), "data")
+}
@@ -0,0 +1,74 @@
+package fsvault
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Update atomically replaces the data at key with the result of fn, holding
+// the key lock from the read to the write. fn is passed the current data and
+// whether the key exists. If fn returns an error nothing is written, and the
+// error is returned.
+func Update(vaultRoot string, vaultKey string, fn func(old []byte, exists bool) ([]byte, error)) error {
+	return vaultAt(vaultRoot).Update(vaultKey, fn)
+}
+
+// UpdateMap atomically modifies the map at key with fn, holding the key lock
+// from the read to the write. fn is passed an empty map if the key doesn't
+// exist. If fn returns an error nothing is written, and the error is
+// returned.
+func UpdateMap[V any](vaultRoot string, vaultKey string, fn func(m map[string]V) error) error {
+	return MapOf[V](vaultAt(vaultRoot)).Update(vaultKey, fn)
+}
+
+// Update atomically replaces the data at key with the result of fn, holding
+// the key lock from the read to the write. fn is passed the current data and
+// whether the key exists. If fn returns an error nothing is written, and the
+// error is returned.
+//
+// Data that exists but can't be read, for example because it can't be
+// decrypted, returns an error without calling fn.
+func (v *Vault) Update(vaultKey string, fn func(old []byte, exists bool) ([]byte, error)) error {
+
+	lock, data, err := v.GetWithLock(vaultKey)
+	defer lock.Unlock()
+
+	exists := true
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		exists = false
+	}
+
+	data, err = fn(data, exists)
+	if err != nil {
+		return err
+	}
+
+	return v.Put(vaultKey, data)
+}
+
+// Update atomically modifies the map at key with fn, holding the key lock
+// from the read to the write. fn is passed an empty map if the key doesn't
+// exist. If fn returns an error nothing is written, and the error is
+// returned.
+//
+// A map that exists but can't be read or decoded returns an error without
+// calling fn, rather than overwriting it with an empty map.
+func (m Map[V]) Update(vaultKey string, fn func(m map[string]V) error) error {
+
+	return m.vault.Update(vaultKey, func(old []byte, exists bool) ([]byte, error) {
+
+		mapData, err := decodeMap[V](vaultKey, old)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := fn(mapData); err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(mapData)
+	})
+}
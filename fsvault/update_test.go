@@ -0,0 +1,83 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdate(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	// create the key
+	err = Update(testRootDir, "/key1", func(old []byte, exists bool) ([]byte, error) {
+		assert.False(t, exists, "new key")
+		return []byte("a"), nil
+	})
+	assert.Equal(t, nil, err, "create")
+
+	// append to the existing data
+	err = Update(testRootDir, "/key1", func(old []byte, exists bool) ([]byte, error) {
+		assert.True(t, exists, "existing key")
+		return append(old, 'b'), nil
+	})
+	assert.Equal(t, nil, err, "append")
+
+	// an error aborts the write
+	errAbort := errors.New("abort")
+	err = Update(testRootDir, "/key1", func(old []byte, exists bool) ([]byte, error) {
+		return []byte("overwritten"), errAbort
+	})
+	assert.Equal(t, errAbort, err, "abort")
+
+	data, err := Get(testRootDir, "/key1")
+	assert.Equal(t, nil, err, "get")
+	assert.Equal(t, "ab", string(data), "get")
+}
+
+func TestUpdateMap(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			UpdateMap(testRootDir, "/counter", func(m map[string]int) error {
+				m["count"]++
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 50, GetMapValue[int](testRootDir, "/counter", "count"), "count")
+
+	// data that isn't a map is not overwritten
+	Put(testRootDir, "/notamap", []byte("[1, 2, 3]"))
+
+	err = UpdateMap(testRootDir, "/notamap", func(m map[string]int) error {
+		m["count"] = 1
+		return nil
+	})
+	assert.True(t, errors.Is(err, ErrCorrupt), "not a map")
+
+	data, _ := Get(testRootDir, "/notamap")
+	assert.Equal(t, "[1, 2, 3]", string(data), "not a map")
+}
@@ -0,0 +1,697 @@
+package fsvault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/thisdougb/go-fsvault/internal/filedata"
+)
+
+// Vault is a datastore rooted at a filesystem path. It owns its encryption
+// keys, cipher, permissions and key locks, so several vaults with different
+// configurations can be used in one process.
+type Vault struct {
+	root       string
+	keysMu     sync.RWMutex // guards keys and prefixKeys, see deriveKeys()
+	keys       []encryptionKey
+	prefixKeys []prefixKeyring // sorted by prefix, see WithPrefixKeys()
+	cipher     string
+	filePerm   os.FileMode
+	dirPerm    os.FileMode
+	durability Durability
+	lockMode   LockMode
+	legacyRead bool
+	requireEnc bool
+	provider   KeyProvider
+
+	rotateOnRead RotateOnRead
+	staleHook    func(StaleKey)
+
+	encryptNames bool
+	namesMu      sync.Mutex
+	names        *nameCipher // nil until first used, see nameCipher()
+
+	checksums      bool
+	integrityKey   *encryptionKey // nil for SHA-256 checksums, if any
+	uncheckedReads bool
+
+	unseal *unsealState // nil if the vault isn't sealed
+	locker *keyLocker
+	keyErr error // why the keyring couldn't be set up, see vaultAt()
+	shared bool  // key material is shared with other vaults, see vaultAt()
+}
+
+// Option configures a Vault when it is opened.
+type Option func(*Vault)
+
+// WithEncryptionKeys sets the encryption keys for the vault, replacing any
+// keys loaded from FSVAULT_SECRET_KEYS. The first key is the primary key,
+// further keys are only used to decrypt data during key rollover.
+//
+// A key can be labelled as "label:secret". The label, or a fingerprint of
+// an unlabelled key, is stored with the data so reads go straight to the
+// right key.
+func WithEncryptionKeys(keys ...string) Option {
+	return func(v *Vault) {
+		wipeKeys(v.keys)
+		v.keys = parseKeys(keys)
+	}
+}
+
+// WithFilePerm sets the permissions used when creating data files.
+func WithFilePerm(perm os.FileMode) Option {
+	return func(v *Vault) {
+		v.filePerm = perm
+	}
+}
+
+// WithDirectoryPerm sets the permissions used when creating key directories.
+func WithDirectoryPerm(perm os.FileMode) Option {
+	return func(v *Vault) {
+		v.dirPerm = perm
+	}
+}
+
+// WithDurability sets how Put syncs data to disk, see Durability.
+func WithDurability(d Durability) Option {
+	return func(v *Vault) {
+		v.durability = d
+	}
+}
+
+// WithLegacyReads sets whether data encrypted before the vault key was
+// bound to the ciphertext can be read, which it is by default so that
+// existing data can be migrated. Once all data has been re-encrypted, turn
+// this off so old files can't be swapped in.
+func WithLegacyReads(allowed bool) Option {
+	return func(v *Vault) {
+		v.legacyRead = allowed
+	}
+}
+
+// WithRequireEncryption sets whether the vault refuses to write unencrypted
+// data. Open returns ErrEncryptionRequired if there are no encryption keys.
+// The default is set by FSVAULT_REQUIRE_ENCRYPTION.
+func WithRequireEncryption(required bool) Option {
+	return func(v *Vault) {
+		v.requireEnc = required
+	}
+}
+
+// Open returns a Vault rooted at root. Without options the vault uses the
+// encryption keys from FSVAULT_SECRET_KEYS and the default permissions.
+func Open(root string, opts ...Option) (_ *Vault, err error) {
+
+	if root == "" {
+		return nil, errors.New("vault root is empty")
+	}
+
+	configMu.RLock()
+	v := &Vault{
+		root:       root,
+		keys:       parseKeys(encryptionKeys),
+		cipher:     cipher,
+		filePerm:   defaultFilePerm,
+		dirPerm:    defaultDirectoryPerm,
+		durability: defaultDurability,
+		legacyRead: true,
+		requireEnc: requireEncryption,
+		lockMode:   lockMode,
+		locker:     newkeyLocker(),
+
+		encryptNames:   encryptNames,
+		checksums:      checksums,
+		integrityKey:   parseIntegrityKey(integrityKey),
+		uncheckedReads: uncheckedReads,
+		rotateOnRead:   rotateOnRead,
+		staleHook:      staleKeyHook,
+	}
+
+	// after Close, don't fill the key caches again
+	if !errors.Is(configErr, ErrClosed) {
+		v.keys = sharedKeys(encryptionKeys)
+		v.integrityKey = sharedIntegrityKey(integrityKey)
+	}
+	configMu.RUnlock()
+
+	// wipe the keys of a vault that failed to open
+	defer func() {
+		if err != nil {
+			v.Close()
+		}
+	}()
+
+	for _, opt := range opts {
+		opt(v)
+	}
+
+	if _, err := lookupCipher(v.cipher); err != nil {
+		return nil, err
+	}
+
+	if v.provider != nil {
+		keys, err := v.provider.Keys(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+		}
+		wipeKeys(v.keys)
+		v.keys = parseKeys(keys)
+	}
+
+	if err := validateKeys(v.keys); err != nil {
+		return nil, err
+	}
+
+	if err := v.validatePrefixKeys(); err != nil {
+		return nil, err
+	}
+
+	if err := validateIntegrityKey(v.integrityKey); err != nil {
+		return nil, err
+	}
+
+	if err := v.loadSeal(); err != nil {
+		return nil, err
+	}
+
+	// a sealed vault gets its key when unsealed
+	if v.requireEnc && !v.hasKeys() && v.unseal == nil {
+		return nil, fmt.Errorf("%w: no encryption keys", ErrEncryptionRequired)
+	}
+
+	if v.encryptNames && len(v.keys) == 0 && v.unseal == nil {
+		return nil, fmt.Errorf("%w: encrypted names need an encryption key",
+			ErrEncryptionRequired)
+	}
+
+	if err := v.deriveKeys(false); err != nil {
+		return nil, err
+	}
+
+	for _, keyring := range v.keyrings() {
+		if err := validateCipherKey(v.cipher, keyring.keys); err != nil {
+			if keyring.prefix != "" {
+				return nil, keyError("open", keyring.prefix, err)
+			}
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// vaultAt returns a Vault at vaultRoot that shares the package level
+// configuration and key locks, backing the package level functions.
+//
+// If the environment config is invalid, or passphrase keys can't be derived,
+// the error is returned by any operation that needs the keys.
+func vaultAt(vaultRoot string) *Vault {
+
+	configMu.RLock()
+	v := &Vault{
+		root:       vaultRoot,
+		cipher:     cipher,
+		filePerm:   defaultFilePerm,
+		dirPerm:    defaultDirectoryPerm,
+		durability: defaultDurability,
+		legacyRead: true,
+		requireEnc: requireEncryption,
+		lockMode:   lockMode,
+		locker:     keylocker,
+		keyErr:     configErr,
+		shared:     true,
+
+		encryptNames:   encryptNames,
+		checksums:      checksums,
+		uncheckedReads: uncheckedReads,
+		rotateOnRead:   rotateOnRead,
+		staleHook:      staleKeyHook,
+	}
+
+	// after Close, don't fill the key caches again
+	if !errors.Is(configErr, ErrClosed) {
+		v.keys = sharedKeys(encryptionKeys)
+		v.integrityKey = sharedIntegrityKey(integrityKey)
+	}
+	configMu.RUnlock()
+
+	if v.keyErr != nil {
+		return v
+	}
+
+	if err := v.deriveKeys(false); err != nil {
+		log.Println("fsvault.vaultAt(): failed to derive keys,", err)
+		v.keyErr = err
+	}
+
+	unseal, err := sharedUnsealState(vaultRoot)
+	if err != nil {
+		log.Println("fsvault.vaultAt(): failed to read vault seal,", err)
+		v.keyErr = err
+	}
+	v.unseal = unseal
+
+	return v
+}
+
+// Root returns the filesystem path the vault is rooted at.
+func (v *Vault) Root() string {
+	return v.root
+}
+
+// fullPath returns the filesystem path for vaultKey, or ErrInvalidKey.
+func (v *Vault) fullPath(vaultKey string) (string, error) {
+
+	if err := validateKey(vaultKey); err != nil {
+		return "", err
+	}
+
+	relative, err := v.diskPath(vaultKey)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(v.root, relative), nil
+}
+
+// KeyExists returns true if data exists at key, and is read/writeable.
+func (v *Vault) KeyExists(vaultKey string) (bool, error) {
+
+	fullPath, err := v.fullPath(vaultKey)
+	if err != nil {
+		return false, keyError("stat", vaultKey, err)
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return false, keyError("stat", vaultKey, err)
+	}
+
+	if info.Mode().Perm()&0600 == 0600 {
+		return true, nil
+	} else {
+		return false, keyError("stat", vaultKey, ErrPermission)
+	}
+}
+
+// Delete removes the file or directory (if empty) at key.
+func (v *Vault) Delete(vaultKey string) error {
+
+	fullPath, err := v.fullPath(vaultKey)
+	if err != nil {
+		return keyError("delete", vaultKey, err)
+	}
+
+	// nothing to delete, so no revision to keep
+	if _, err = os.Lstat(fullPath); err != nil {
+		return keyError("delete", vaultKey, err)
+	}
+
+	lock, revPath, err := v.lockRevision(vaultKey)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// keep the revision of data written before revisions were recorded, so
+	// it isn't reused. Data that can't be read is deleted anyway
+	if current, err := readRevision(fullPath); err == nil {
+		err = keepLastRevision(revPath, current, v.filePerm, v.durability)
+		if err != nil {
+			return keyError("delete", vaultKey, err)
+		}
+	}
+
+	err = os.Remove(fullPath)
+	if err != nil {
+		return keyError("delete", vaultKey, err)
+	}
+	return nil
+}
+
+// List returns an alphabetically sorted list of the object names found a key.
+func (v *Vault) List(vaultKey string) []string {
+
+	keysFound := []string{}
+
+	fullPath, err := v.fullPath(vaultKey)
+	if err != nil {
+		return keysFound
+	}
+
+	dir, err := os.Open(fullPath)
+	if err != nil {
+		return keysFound
+	}
+	defer dir.Close()
+
+	files, err := dir.ReadDir(-1)
+	if err != nil {
+		return keysFound
+	}
+
+	for _, f := range files {
+
+		if isInternalName(f.Name()) {
+			continue
+		}
+
+		name, err := v.nameFromDisk(vaultKey, f.Name())
+		if err != nil {
+			log.Println("fsvault.List(): skipping", f.Name(), err)
+			continue
+		}
+
+		foundKey := filepath.Join(vaultKey, name)
+		if f.IsDir() {
+			foundKey = foundKey + "/"
+		}
+		keysFound = append(keysFound, foundKey)
+	}
+
+	slices.Sort(keysFound)
+	return keysFound
+}
+
+// Put writes data to a file at key, overwriting if the file exists. The
+// write is atomic, see Durability for how it is synced to disk.
+//
+// If encryption keys are present then the primary (first) key is used to
+// encrypt the data.
+func (v *Vault) Put(vaultKey string, data []byte) error {
+	return v.put(vaultKey, data, nextRevision)
+}
+
+// put writes data to a file at key with the revision from revision.
+func (v *Vault) put(vaultKey string, data []byte, revision revisionFunc) error {
+
+	// slight of hand here. we are really only checking if we can't write to
+	// this key. we don't care if there's a file there already, or not.
+	_, err := v.KeyExists(vaultKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	if v.keyErr != nil {
+		return keyError("put", vaultKey, v.keyErr)
+	}
+
+	if err := v.checkSealed(); err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	keys := v.keyring(vaultKey)
+
+	if v.requireEnc && len(keys) == 0 {
+		return keyError("put", vaultKey, ErrEncryptionRequired)
+	}
+
+	fd := &filedata.FileData{}
+	fd.Data = data
+	fd.Version = formatVersion
+
+	if v.cipher != "" && len(keys) > 0 {
+		if err := v.seal(vaultKey, fd, data); err != nil {
+			return err
+		}
+	}
+
+	return v.writeFileData(vaultKey, fd, revision)
+}
+
+// writeFileData writes fd to the file at key, with the revision from
+// revision, under the revision lock.
+func (v *Vault) writeFileData(vaultKey string, fd *filedata.FileData, revision revisionFunc) error {
+
+	if err := v.checkSealed(); err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	fullPath, err := v.fullPath(vaultKey)
+	if err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	lock, revPath, err := v.lockRevision(vaultKey)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	last, err := readLastRevision(revPath)
+	if err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	current, err := readRevision(fullPath)
+
+	fd.Revision, err = revision(current, last, err)
+	if err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	if fd.Revision > last {
+		err = writeLastRevision(revPath, fd.Revision, v.filePerm, v.durability)
+		if err != nil {
+			return keyError("put", vaultKey, err)
+		}
+	}
+
+	v.addChecksum(vaultKey, fd)
+
+	fdJSON, _ := json.Marshal(fd)
+
+	// write the file as the last stage, so we reduce the chances of partial
+	// dir/file creation
+	if err = mkdirAll(filepath.Dir(fullPath), v.dirPerm, v.durability); err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	err = writeFileAtomic(fullPath, fdJSON, v.filePerm, v.durability)
+	if err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	return nil
+}
+
+// PutContext is Put, but returns ctx.Err() if ctx is done before the write.
+func (v *Vault) PutContext(ctx context.Context, vaultKey string, data []byte) error {
+
+	if err := ctx.Err(); err != nil {
+		return keyError("put", vaultKey, err)
+	}
+
+	return v.Put(vaultKey, data)
+}
+
+// GetWithLock returns a locked mutex with the data, enabling synchronised
+// key updates. The caller must Unlock() the lock, even if there is an error.
+func (v *Vault) GetWithLock(vaultKey string) (Unlocker, []byte, error) {
+
+	lock, err := v.lock(vaultKey, false)
+	if err != nil {
+		return lock, []byte{}, err
+	}
+
+	data, err := v.Get(vaultKey)
+
+	return lock, data, err
+}
+
+// GetWithRLock returns a shared lock with the data. Readers don't block each
+// other, only writers holding the lock. The caller must Unlock() the lock,
+// even if there is an error.
+func (v *Vault) GetWithRLock(vaultKey string) (Unlocker, []byte, error) {
+
+	lock, err := v.lock(vaultKey, true)
+	if err != nil {
+		return lock, []byte{}, err
+	}
+
+	data, err := v.Get(vaultKey)
+
+	return lock, data, err
+}
+
+// GetWithLockContext is GetWithLock, but gives up waiting for the lock when
+// ctx is done. If the lock isn't acquired the Unlocker is nil and the error
+// wraps ctx.Err(), otherwise the caller must Unlock() the lock.
+func (v *Vault) GetWithLockContext(ctx context.Context, vaultKey string) (Unlocker, []byte, error) {
+
+	lock, err := v.lockContext(ctx, vaultKey, false)
+	if err != nil {
+		return nil, []byte{}, err
+	}
+
+	data, err := v.Get(vaultKey)
+
+	return lock, data, err
+}
+
+// GetContext is Get, but returns ctx.Err() if ctx is done before the read.
+func (v *Vault) GetContext(ctx context.Context, vaultKey string) ([]byte, error) {
+
+	if err := ctx.Err(); err != nil {
+		return []byte{}, keyError("get", vaultKey, err)
+	}
+
+	return v.Get(vaultKey)
+}
+
+// Get returns the data at key, or an error.
+//
+// If encryption keys are present, and a non-primary encryption key successfully
+// decrypted the data, then the data is re-stored using the primary encryption
+// key, unless WithRotateOnRead says otherwise. See the main documentation for
+// more on encryption key rollover.
+func (v *Vault) Get(vaultKey string) ([]byte, error) {
+
+	data, _, err := v.get(vaultKey)
+	return data, err
+}
+
+// get returns the data and revision at key, or an error.
+func (v *Vault) get(vaultKey string) ([]byte, uint64, error) {
+
+	fd, err := v.readFileData(vaultKey)
+	if err != nil {
+		return nil, 0, keyError("get", vaultKey, err)
+	}
+
+	if fd.Cipher == "" {
+		return fd.Data, fd.Revision, nil
+	}
+
+	data, i, err := v.decrypt(vaultKey, fd)
+	if err != nil {
+		return []byte{}, 0, keyError("get", vaultKey, err)
+	}
+
+	// if the key or cipher is old, or the data is in an old format,
+	// refresh data with the latest key, cipher and format
+	keys := v.keyring(vaultKey)
+	if len(keys) > 0 && v.stale(fd, i) {
+		v.staleRead(vaultKey, fd, keys[i].id, data)
+	}
+
+	return data, fd.Revision, nil
+}
+
+// readFileData returns the FileData stored at key, without decrypting it.
+func (v *Vault) readFileData(vaultKey string) (*filedata.FileData, error) {
+
+	if err := v.checkSealed(); err != nil {
+		return nil, err
+	}
+
+	fullPath, err := v.fullPath(vaultKey)
+	if err != nil {
+		return nil, err
+	}
+
+	filecontent, err := os.ReadFile(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fd := &filedata.FileData{}
+
+	// unencrypted data is in the file content, so don't leave it around
+	err = json.Unmarshal(filecontent, fd)
+	clear(filecontent)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+
+	if err := v.verifyChecksum(vaultKey, fd); err != nil {
+		return nil, err
+	}
+
+	return fd, nil
+}
+
+// decrypt returns the decrypted data, and the position in the keyring of the
+// key that decrypted it. Enveloped data is decrypted with its data key,
+// unwrapped by the key with its key id. Data with a key id goes straight to
+// that key, older data without one tries each key in turn.
+func (v *Vault) decrypt(vaultKey string, fd *filedata.FileData) ([]byte, int, error) {
+
+	if fd.Version < formatBound && !v.legacyRead {
+		return nil, -1, fmt.Errorf("%w: legacy format %d is not allowed",
+			ErrDecrypt, fd.Version)
+	}
+
+	if v.keyErr != nil {
+		return nil, -1, fmt.Errorf("%w: %w", ErrDecrypt, v.keyErr)
+	}
+
+	c, err := lookupCipher(fd.Cipher)
+	if err != nil {
+		return nil, -1, fmt.Errorf("%w: %w", ErrDecrypt, err)
+	}
+
+	ad := additionalData(vaultKey, fd.Version)
+	keys := v.keyring(vaultKey)
+
+	if fd.DataKey != nil {
+
+		dataKey, i, err := v.unwrap(vaultKey, fd, c)
+		if err != nil {
+			return nil, i, err
+		}
+		defer clear(dataKey)
+
+		decryptedData, err := c.Open(dataKey, fd.Data, ad)
+		if err != nil {
+			return nil, i, fmt.Errorf("%w: %w", ErrCorrupt, err)
+		}
+
+		return decryptedData, i, nil
+	}
+
+	if fd.KeyID != "" {
+
+		i := keyIndex(keys, fd.KeyID)
+		if i < 0 {
+			return nil, -1, fmt.Errorf("%w: key id %s is not in the keyring",
+				ErrDecrypt, fd.KeyID)
+		}
+
+		decryptedData, err := c.Open(keys[i].secret.Bytes(), fd.Data, ad)
+		if err != nil {
+			// the right key can't decrypt it, so the data has been changed
+			return nil, i, fmt.Errorf("%w: key id %s: %w", ErrCorrupt, fd.KeyID, err)
+		}
+
+		return decryptedData, i, nil
+	}
+
+	if len(keys) == 0 {
+		return nil, -1, fmt.Errorf("%w: no encryption keys", ErrDecrypt)
+	}
+
+	// keys[0] is the most current
+	for i, k := range keys {
+
+		var decryptedData []byte
+
+		decryptedData, err = c.Open(k.secret.Bytes(), fd.Data, ad)
+		if err == nil {
+			return decryptedData, i, nil
+		}
+
+		// decryption failed, try the next available key
+	}
+
+	// we tried all the keys, we can't decrypt
+	return nil, -1, fmt.Errorf("%w: %w", ErrDecrypt, err)
+}
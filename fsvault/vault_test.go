@@ -0,0 +1,121 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpen(t *testing.T) {
+
+	_, err := Open("")
+	assert.NotEqual(t, nil, err, "empty root")
+
+	v, err := Open("/tmp/fsvault", WithFilePerm(0600), WithDirectoryPerm(0700))
+	assert.Equal(t, nil, err, "with options")
+	assert.Equal(t, "/tmp/fsvault", v.Root(), "root")
+	assert.Equal(t, os.FileMode(0600), v.filePerm, "file perm")
+	assert.Equal(t, os.FileMode(0700), v.dirPerm, "directory perm")
+}
+
+/*
+Test vaults with different keys can be used side by side, and in parallel.
+*/
+func TestVaultsWithDifferentKeys(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretKey2 = "mylongsecdddddwwwwdtmylongsecret"
+		secretData = "some super secret data"
+		vaultKey   = "/test/data"
+	)
+
+	testCases := []struct {
+		description string
+		secretKeys  []string
+	}{
+		{
+			description: "vault with key1",
+			secretKeys:  []string{secretKey1},
+		},
+		{
+			description: "vault with key2",
+			secretKeys:  []string{secretKey2},
+		},
+		{
+			description: "vault with no keys",
+			secretKeys:  []string{},
+		},
+	}
+
+	vaults := []*Vault{}
+
+	for _, tc := range testCases {
+
+		// removed when the parallel subtests are done, unlike a defer
+		testRootDir := t.TempDir()
+
+		v, err := Open(testRootDir, WithEncryptionKeys(tc.secretKeys...))
+		assert.Equal(t, nil, err, tc.description)
+
+		vaults = append(vaults, v)
+	}
+
+	// the group returns when all its parallel subtests are done
+	t.Run("parallel", func(t *testing.T) {
+		for i, tc := range testCases {
+
+			t.Run(tc.description, func(t *testing.T) {
+				t.Parallel()
+
+				v := vaults[i]
+
+				err := v.Put(vaultKey, []byte(secretData))
+				assert.Equal(t, nil, err, tc.description)
+
+				data, err := v.Get(vaultKey)
+				assert.Equal(t, nil, err, tc.description)
+				assert.Equal(t, secretData, string(data), tc.description)
+			})
+		}
+	})
+
+	// data encrypted by one vault can't be read by another
+	other, err := Open(vaults[0].Root(), WithEncryptionKeys(secretKey2))
+	assert.Equal(t, nil, err, "open with key2")
+
+	_, err = other.Get(vaultKey)
+	assert.True(t, errors.Is(err, ErrDecrypt), "read key1 data with key2")
+}
+
+func TestMapOf(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v, err := Open(testRootDir, WithEncryptionKeys("eheheheheheheheheheheheheheheheh"))
+	assert.Equal(t, nil, err, "open")
+
+	m := MapOf[TestValue](v)
+	testMapKey := "/testmap"
+
+	m.PutValue(testMapKey, "key1", TestValue{"value1"})
+	m.PutValue(testMapKey, "key2", TestValue{"value2"})
+	m.DeleteValue(testMapKey, "key2")
+
+	lock, value, err := m.GetValueWithLock(testMapKey, "key1")
+	lock.Unlock()
+	assert.Equal(t, nil, err, "key1")
+	assert.Equal(t, "value1", value.Id, "key1")
+
+	data, err := m.Get(testMapKey)
+	assert.Equal(t, nil, err, "map")
+	assert.Equal(t, 1, len(data), "map length")
+}
@@ -0,0 +1,173 @@
+package fsvault
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/thisdougb/go-fsvault/internal/filedata"
+)
+
+// Every Put increments the revision stored with the data, starting at 1. A
+// key that doesn't exist has revision 0. Revisions give optimistic
+// concurrency: read with GetVersioned, then write with PutIfVersion, which
+// fails with ErrConflict if anyone else wrote the key in between.
+//
+// Every write reads the current revision and writes the next under the
+// revision lock, an in-process lock and lock file kept apart from the key
+// lock, so writes can be made while holding the key lock. So no two writes
+// get the same revision, even across processes.
+//
+// The revision lock file also holds the last revision written, which
+// Delete leaves behind, so a key written again after a Delete carries on
+// from its old revision rather than reusing it.
+
+// revisionFunc returns the revision to write, given the current revision
+// or the error reading it and the last revision written to the key, or an
+// error if the write mustn't happen.
+type revisionFunc func(current uint64, last uint64, err error) (uint64, error)
+
+// sameRevision returns the revisionFunc for re-storing data read at
+// revision, which returns ErrConflict if it has since been written.
+func sameRevision(revision uint64) revisionFunc {
+	return func(current uint64, last uint64, err error) (uint64, error) {
+		if err != nil {
+			return 0, err
+		}
+		if current != revision {
+			return 0, ErrConflict
+		}
+		return current, nil
+	}
+}
+
+// nextRevision is the revisionFunc for an unconditional write. Data that
+// can't be read is overwritten, after the last revision.
+func nextRevision(current uint64, last uint64, err error) (uint64, error) {
+	return max(current, last) + 1, nil
+}
+
+// GetVersioned returns the data at key and its revision, or an error.
+func GetVersioned(vaultRoot string, vaultKey string) ([]byte, uint64, error) {
+	return vaultAt(vaultRoot).GetVersioned(vaultKey)
+}
+
+// PutIfVersion writes data to key only if its revision is still
+// expectedRev, otherwise it returns ErrConflict. Use expectedRev 0 to only
+// create a new key.
+func PutIfVersion(vaultRoot string, vaultKey string, data []byte, expectedRev uint64) error {
+	return vaultAt(vaultRoot).PutIfVersion(vaultKey, data, expectedRev)
+}
+
+// GetVersioned returns the data at key and its revision, or an error.
+func (v *Vault) GetVersioned(vaultKey string) ([]byte, uint64, error) {
+	return v.get(vaultKey)
+}
+
+// PutIfVersion writes data to key only if its revision is still
+// expectedRev, otherwise it returns ErrConflict. Use expectedRev 0 to only
+// create a new key.
+//
+// The check and write happen under the revision lock, including its lock
+// file whatever the LockMode, so PutIfVersion is safe across processes.
+func (v *Vault) PutIfVersion(vaultKey string, data []byte, expectedRev uint64) error {
+
+	return v.put(vaultKey, data, func(current uint64, last uint64, err error) (uint64, error) {
+		if err != nil {
+			return 0, err
+		}
+		if current != expectedRev {
+			return 0, ErrConflict
+		}
+		return max(current, last) + 1, nil
+	})
+}
+
+// lockRevision takes the revision lock for vaultKey, which is held only
+// while writing, returning the path of its lock file. Platforms without file
+// locks fall back to the in-process lock.
+func (v *Vault) lockRevision(vaultKey string) (Unlocker, string, error) {
+
+	revPath, err := v.keyLockPath(vaultKey, revisionLockExt)
+	if err != nil {
+		return nil, "", keyError("lock", vaultKey, err)
+	}
+
+	f, err := v.openLockPath(revPath)
+	lock, err := v.lockExclusive(vaultKey, internalLock(revisionLockExt+canonicalKey(vaultKey)), f, err)
+
+	return lock, revPath, err
+}
+
+// readLastRevision returns the last revision written to the key, held in its
+// revision lock file at revPath, or 0 if none has been recorded.
+func readLastRevision(revPath string) (uint64, error) {
+
+	b, err := os.ReadFile(revPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// a new lock file is empty
+	if len(b) < 8 {
+		return 0, nil
+	}
+
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// keepLastRevision records revision in the revision lock file at revPath,
+// if it is after the last revision recorded.
+func keepLastRevision(revPath string, revision uint64, perm os.FileMode, durability Durability) error {
+
+	last, err := readLastRevision(revPath)
+	if err != nil || revision <= last {
+		return err
+	}
+
+	return writeLastRevision(revPath, revision, perm, durability)
+}
+
+// writeLastRevision records revision in the revision lock file at revPath.
+// The file is written in place, as replacing it would lose the flock.
+func writeLastRevision(revPath string, revision uint64, perm os.FileMode, durability Durability) error {
+
+	f, err := os.OpenFile(revPath, os.O_WRONLY|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(binary.BigEndian.AppendUint64(nil, revision), 0)
+	if err == nil && durability >= DurabilityFile {
+		err = f.Sync()
+	}
+
+	return errors.Join(err, f.Close())
+}
+
+// readRevision returns the revision of the data at fullPath, 0 if there is
+// no data.
+func readRevision(fullPath string) (uint64, error) {
+
+	filecontent, err := os.ReadFile(fullPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	fd := filedata.FileData{}
+
+	err = json.Unmarshal(filecontent, &fd)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+
+	return fd.Revision, nil
+}
@@ -0,0 +1,200 @@
+//go:build dev
+
+package fsvault
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPutIfVersion(t *testing.T) {
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v, err := Open(testRootDir)
+	assert.Equal(t, nil, err, "open")
+
+	testCases := []struct {
+		description string
+		data        string
+		expectedRev uint64
+		expectError error
+		expectData  string
+		expectRev   uint64
+	}{
+		{
+			description: "create new key",
+			data:        "data1",
+			expectedRev: 0,
+			expectError: nil,
+			expectData:  "data1",
+			expectRev:   1,
+		},
+		{
+			description: "create existing key",
+			data:        "data2",
+			expectedRev: 0,
+			expectError: ErrConflict,
+			expectData:  "data1",
+			expectRev:   1,
+		},
+		{
+			description: "update current revision",
+			data:        "data3",
+			expectedRev: 1,
+			expectError: nil,
+			expectData:  "data3",
+			expectRev:   2,
+		},
+		{
+			description: "update stale revision",
+			data:        "data4",
+			expectedRev: 1,
+			expectError: ErrConflict,
+			expectData:  "data3",
+			expectRev:   2,
+		},
+	}
+
+	for _, tc := range testCases {
+
+		err := v.PutIfVersion("/key1", []byte(tc.data), tc.expectedRev)
+		if tc.expectError == nil {
+			assert.Equal(t, nil, err, tc.description)
+		} else {
+			assert.True(t, errors.Is(err, tc.expectError), tc.description)
+		}
+
+		data, rev, err := v.GetVersioned("/key1")
+		assert.Equal(t, nil, err, tc.description)
+		assert.Equal(t, tc.expectData, string(data), tc.description)
+		assert.Equal(t, tc.expectRev, rev, tc.description)
+	}
+
+	// a blind Put still moves the revision on
+	v.Put("/key1", []byte("data5"))
+
+	err = v.PutIfVersion("/key1", []byte("data6"), 2)
+	assert.True(t, errors.Is(err, ErrConflict), "stale after Put")
+}
+
+/*
+Test re-encryption on read doesn't change the revision, as the data hasn't
+changed.
+*/
+func TestRevisionKeyRollover(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretKey2 = "mylongsecdddddwwwwdtmylongsecret"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	v1, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	v1.Put("/key1", []byte("some data"))
+
+	v2, _ := Open(testRootDir, WithEncryptionKeys(secretKey2, secretKey1))
+
+	_, rev, err := v2.GetVersioned("/key1")
+	assert.Equal(t, nil, err, "rolled read")
+	assert.Equal(t, uint64(1), rev, "rolled read")
+
+	_, rev, err = v2.GetVersioned("/key1")
+	assert.Equal(t, nil, err, "second read")
+	assert.Equal(t, uint64(1), rev, "second read")
+}
+
+/*
+Test revisions only move forward, with concurrent writers that don't share
+in-process locks, as separate processes wouldn't.
+*/
+func TestRevisionsMonotonic(t *testing.T) {
+
+	var (
+		secretKey1 = "eheheheheheheheheheheheheheheheh"
+		secretKey2 = "mylongsecdddddwwwwdtmylongsecret"
+	)
+
+	testRootDir, err := os.MkdirTemp("", "thisdougb-fsvault")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer os.RemoveAll(testRootDir) // clean up
+
+	done := make(chan bool)
+
+	for i := 0; i < 4; i++ {
+
+		v, err := Open(testRootDir)
+		assert.Equal(t, nil, err, "open")
+
+		go func(v *Vault) {
+			for j := 0; j < 25; j++ {
+				v.Put("/counter", []byte("data"))
+			}
+			done <- true
+		}(v)
+	}
+
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	_, rev, err := GetVersioned(testRootDir, "/counter")
+	assert.Equal(t, nil, err, "concurrent puts")
+	assert.Equal(t, uint64(100), rev, "concurrent puts")
+
+	// re-encrypting data read before a newer write leaves the newer write
+	v1, _ := Open(testRootDir, WithEncryptionKeys(secretKey1))
+	v1.Put("/key1", []byte("old data"))
+	stale := readFileData(t, testRootDir, "/key1")
+
+	v2, _ := Open(testRootDir, WithEncryptionKeys(secretKey2, secretKey1))
+	v2.Put("/key1", []byte("new data"))
+
+	err = v2.refresh("/key1", stale, []byte("old data"))
+	assert.Equal(t, nil, err, "refresh")
+
+	data, rev, err := v2.GetVersioned("/key1")
+	assert.Equal(t, nil, err, "refreshed read")
+	assert.Equal(t, "new data", string(data), "refreshed read")
+	assert.Equal(t, uint64(2), rev, "refreshed read")
+
+	// versioned writes don't need the key lock, so can be made holding it
+	lock := v2.LockKey("/key1")
+	err = v2.PutIfVersion("/key1", []byte("locked data"), 2)
+	lock.Unlock()
+	assert.Equal(t, nil, err, "put if version holding key lock")
+
+	// a key written again after a delete doesn't reuse a revision
+	_, rev, _ = v2.GetVersioned("/key1")
+	assert.Equal(t, nil, v2.Delete("/key1"), "delete")
+	assert.Equal(t, nil, v2.Put("/key1", []byte("recreated")), "put after delete")
+
+	err = v2.PutIfVersion("/key1", []byte("stale data"), rev)
+	assert.True(t, errors.Is(err, ErrConflict), "put if version after delete")
+
+	_, recreated, _ := v2.GetVersioned("/key1")
+	assert.Equal(t, rev+1, recreated, "revision after delete")
+
+	// including data written before revisions were kept
+	os.RemoveAll(filepath.Join(testRootDir, lockDirName))
+	assert.Equal(t, nil, v2.Delete("/key1"), "delete")
+	assert.Equal(t, nil, v2.PutIfVersion("/key1", []byte("created"), 0), "create after delete")
+
+	_, created, _ := v2.GetVersioned("/key1")
+	assert.Equal(t, recreated+1, created, "revision after delete")
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/thisdougb/go-fsvault/fsvault"
+	"github.com/thisdougb/go-fsvault/internal/config"
 )
 
 /*
@@ -14,34 +18,69 @@ fsvcli provides a command line interface to an fsvault datastore.
 */
 func main() {
 
+	defaultRootDir := config.StringValue("FSVAULT_DATADIR")
+
 	refreshCmd := flag.NewFlagSet("refresh", flag.ExitOnError)
-	refreshRootDir := refreshCmd.String("rootdir", "", "root vault directory")
+	refreshRootDir := refreshCmd.String("rootdir", defaultRootDir, "root vault directory")
 	refreshKey := refreshCmd.String("key", "", "key to the data")
 
+	rotateCmd := flag.NewFlagSet("rotate", flag.ExitOnError)
+	rotateRootDir := rotateCmd.String("rootdir", defaultRootDir, "root vault directory")
+	rotatePrefix := rotateCmd.String("prefix", "", "only rotate keys under this key")
+	rotateConcurrency := rotateCmd.Int("concurrency", 1, "number of keys rotated at once")
+	rotateDryRun := rotateCmd.Bool("dryrun", false, "report what would be rotated, without rotating")
+
+	keysReportCmd := flag.NewFlagSet("keys report", flag.ExitOnError)
+	keysReportRootDir := keysReportCmd.String("rootdir", defaultRootDir, "root vault directory")
+	keysReportPrefix := keysReportCmd.String("prefix", "", "only report keys under this key")
+
 	getCmd := flag.NewFlagSet("get", flag.ExitOnError)
-	getRootDir := getCmd.String("rootdir", "", "root vault directory")
+	getRootDir := getCmd.String("rootdir", defaultRootDir, "root vault directory")
 	getKey := getCmd.String("key", "", "key to the data")
+	getVersion := getCmd.Bool("version", false, "print the data revision instead of the data")
 
 	putCmd := flag.NewFlagSet("put", flag.ExitOnError)
-	putRootDir := putCmd.String("rootdir", "", "root vault directory")
+	putRootDir := putCmd.String("rootdir", defaultRootDir, "root vault directory")
 	putKey := putCmd.String("key", "", "key to the data")
 	putData := putCmd.String("data", "", "data to store")
+	putIfVersion := putCmd.Int64("ifversion", -1, "only put if the data revision is unchanged, 0 to only create")
 
 	listCmd := flag.NewFlagSet("list", flag.ExitOnError)
-	listRootDir := listCmd.String("rootdir", "", "root vault directory")
+	listRootDir := listCmd.String("rootdir", defaultRootDir, "root vault directory")
 	listKey := listCmd.String("key", "", "key to the data")
 
 	deleteCmd := flag.NewFlagSet("delete", flag.ExitOnError)
-	deleteRootDir := deleteCmd.String("rootdir", "", "root vault directory")
+	deleteRootDir := deleteCmd.String("rootdir", defaultRootDir, "root vault directory")
 	deleteKey := deleteCmd.String("key", "", "key to the data")
 
+	sealCmd := flag.NewFlagSet("seal", flag.ExitOnError)
+	sealRootDir := sealCmd.String("rootdir", defaultRootDir, "root vault directory")
+	sealShares := sealCmd.Int("shares", 5, "number of unseal shares to create")
+	sealThreshold := sealCmd.Int("threshold", 3, "number of shares needed to unseal")
+
+	unsealCmd := flag.NewFlagSet("unseal", flag.ExitOnError)
+	unsealRootDir := unsealCmd.String("rootdir", defaultRootDir, "root vault directory")
+
 	if len(os.Args) < 2 {
 		fmt.Println(`
 The fsvcli tool interacts with an FSVault key/value datastore.
 
-Two environment variables control configuration:
+Environment variables control configuration:
 
+    FSVAULT_DATADIR       the datastore filesystem path, defaults to /tmp
     FSVAULT_SECRET_KEYS   a list of encryption keys, see docs for more information
+    FSVAULT_SECRET_KEYS_FILE     a file of encryption keys, readable only by its owner
+    FSVAULT_SECRET_KEYS_COMMAND  a command that prints the encryption keys
+    FSVAULT_CIPHER        the cipher for new data, AES-GCM (default) or ChaCha20-Poly1305
+    FSVAULT_REQUIRE_ENCRYPTION  refuse to write unencrypted data, true or false (default)
+    FSVAULT_ENCRYPT_NAMES  encrypt key names on disk, true or false (default)
+    FSVAULT_CHECKSUMS     store a SHA-256 checksum with each value, true or false (default)
+    FSVAULT_INTEGRITY_KEY  a key for HMAC-SHA256 checksums, which catch deliberate edits
+    FSVAULT_UNCHECKED_READS  read values without a checksum while adding them, true or false (default)
+    FSVAULT_ROTATE_ON_READ  re-encrypt old data when read, lazy (default), locked or never
+    FSVAULT_LOCK_FILES    lock keys with lock files, shared with other processes, true or false (default)
+
+A true or false setting with any other value is a config error.
 
 Usage:
 
@@ -54,6 +93,10 @@ The commands are:
     delete    delete a key in the datastore
     list      list keys at a datastore path
     refresh   refresh encryption for a key/value
+    rotate    refresh encryption for all keys/values
+    keys      report encryption key usage, with "keys report"
+    seal      seal the datastore, printing the unseal shares
+    unseal    read unseal shares from stdin, then run a command
 
 Use "fsvcli <command> -h" for more information about a command.
 
@@ -68,8 +111,41 @@ Examples:
 		os.Exit(1)
 	}
 
+	// don't carry on without encryption if the keys are wrong
+	if err := fsvault.Configure(); err != nil {
+		log.Println("fsvcli:", err)
+		os.Exit(1)
+	}
+
+	// unseal reads the shares, then runs the rest of the command line as
+	// a command against the unsealed datastore
+	if os.Args[1] == "unseal" {
+		unsealCmd.Parse(os.Args[2:])
+		err := readUnsealShares(os.Stdin)
+		if err != nil {
+			os.Exit(1)
+		}
+
+		if unsealCmd.NArg() == 0 {
+			err = checkUnsealed(*unsealRootDir)
+			if err != nil {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+
+		os.Args = append(os.Args[:1], unsealCmd.Args()...)
+	}
+
 	switch os.Args[1] {
 
+	case "seal":
+		sealCmd.Parse(os.Args[2:])
+		err := sealVault(*sealRootDir, *sealShares, *sealThreshold)
+		if err != nil {
+			os.Exit(1)
+		}
+
 	case "refresh":
 		refreshCmd.Parse(os.Args[2:])
 		err := refreshDataAtKey(*refreshRootDir, *refreshKey)
@@ -77,16 +153,34 @@ Examples:
 			os.Exit(1)
 		}
 
+	case "rotate":
+		rotateCmd.Parse(os.Args[2:])
+		err := rotateDataAtKey(*rotateRootDir, *rotatePrefix, *rotateConcurrency, *rotateDryRun)
+		if err != nil {
+			os.Exit(1)
+		}
+
+	case "keys":
+		if len(os.Args) < 3 || os.Args[2] != "report" {
+			fmt.Println("usage: fsvcli keys report [arguments]")
+			os.Exit(1)
+		}
+		keysReportCmd.Parse(os.Args[3:])
+		err := reportKeys(*keysReportRootDir, *keysReportPrefix)
+		if err != nil {
+			os.Exit(1)
+		}
+
 	case "get":
 		getCmd.Parse(os.Args[2:])
-		err := getDataAtKey(*getRootDir, *getKey)
+		err := getDataAtKey(*getRootDir, *getKey, *getVersion)
 		if err != nil {
 			os.Exit(1)
 		}
 
 	case "put":
 		putCmd.Parse(os.Args[2:])
-		err := putDataAtKey(*putRootDir, *putKey, *putData)
+		err := putDataAtKey(*putRootDir, *putKey, *putData, *putIfVersion)
 		if err != nil {
 			os.Exit(1)
 		}
@@ -107,24 +201,240 @@ Examples:
 	os.Exit(0)
 }
 
+// unsealShares are read by the unseal command, and given to the vault.
+var unsealShares []string
+
+/*
+openVault opens the vault with file locks, so the cli is serialised with
+any app using the same vault with fsvault.LockFile. A sealed vault is
+unsealed with any shares from the unseal command.
+*/
+func openVault(rootDir string) (*fsvault.Vault, error) {
+
+	vault, err := fsvault.Open(rootDir, fsvault.WithLockMode(fsvault.LockFile))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, share := range unsealShares {
+		if _, err := vault.Unseal(share); err != nil {
+			vault.Close()
+			return nil, err
+		}
+	}
+
+	return vault, nil
+}
+
+/*
+Seal the vault with a new key, split into shares. The shares are only
+printed here, one per line, and should each go to a different person.
+*/
+func sealVault(rootDir string, shares int, threshold int) error {
+
+	vault, err := openVault(rootDir)
+	if err != nil {
+		log.Println("sealVault():", err)
+		return err
+	}
+
+	defer vault.Close()
+
+	parts, err := vault.InitSeal(shares, threshold)
+	if err != nil {
+		log.Println("sealVault():", err)
+		return err
+	}
+
+	for _, share := range parts {
+		fmt.Printf("%s\n", share)
+	}
+
+	return nil
+}
+
+/*
+Read unseal shares from r, one per line until EOF, so they can be typed in
+turn or piped in.
+*/
+func readUnsealShares(r io.Reader) error {
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		share := strings.TrimSpace(scanner.Text())
+		if share != "" {
+			unsealShares = append(unsealShares, share)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Println("readUnsealShares():", err)
+		return err
+	}
+
+	return nil
+}
+
+/*
+With no command to run, unseal just checks the shares unseal the vault.
+*/
+func checkUnsealed(rootDir string) error {
+
+	vault, err := openVault(rootDir)
+	if err != nil {
+		log.Println("checkUnsealed():", err)
+		return err
+	}
+
+	defer vault.Close()
+
+	if vault.Sealed() {
+		err = fsvault.ErrSealed
+		log.Println("checkUnsealed(): not enough shares,", err)
+		return err
+	}
+
+	fmt.Println("unsealed")
+
+	return nil
+}
+
 /*
-If we read a path then it is automatically re-encrypted with the newer
-encryption key.
+Rewrap re-encrypts the data key with the newer encryption key, and older
+data is re-encrypted in full.
 */
 func refreshDataAtKey(rootDir string, key string) error {
 
-	_, err := fsvault.Get(rootDir, key)
+	vault, err := openVault(rootDir)
 	if err != nil {
 		log.Println("refreshDataAtKey():", err)
 		return err
 	}
 
+	defer vault.Close()
+
+	err = vault.Rewrap(key)
+	if err != nil {
+		log.Println("refreshDataAtKey():", err)
+		return err
+	}
+
+	return nil
+}
+
+/*
+Rotate re-encrypts every key under prefix that isn't using the primary
+encryption key. It is safe to run again if interrupted, keys already rotated
+are skipped.
+*/
+func rotateDataAtKey(rootDir string, prefix string, concurrency int, dryRun bool) error {
+
+	vault, err := openVault(rootDir)
+	if err != nil {
+		log.Println("rotateDataAtKey():", err)
+		return err
+	}
+
+	defer vault.Close()
+
+	report, err := vault.Rotate(fsvault.RotateOptions{
+		Prefix:      prefix,
+		Concurrency: concurrency,
+		DryRun:      dryRun,
+	})
+	if err != nil {
+		log.Println("rotateDataAtKey():", err)
+		return err
+	}
+
+	for _, err := range report.Errors {
+		fmt.Printf("failed: %s\n", err)
+	}
+
+	fmt.Printf("rotated %d, current %d, unencrypted %d, failed %d\n",
+		report.Rotated, report.Current, report.Unencrypted, report.Failed)
+
+	if report.Failed > 0 {
+		return fmt.Errorf("%d keys failed to rotate", report.Failed)
+	}
+
+	return nil
+}
+
+/*
+Report the values each encryption key is used by, so an old key can be
+removed once nothing uses it. Values no key can decrypt are listed last.
+*/
+func reportKeys(rootDir string, prefix string) error {
+
+	vault, err := openVault(rootDir)
+	if err != nil {
+		log.Println("reportKeys():", err)
+		return err
+	}
+
+	defer vault.Close()
+
+	report, err := vault.ReportKeys(prefix)
+	if err != nil {
+		log.Println("reportKeys():", err)
+		return err
+	}
+
+	for i, k := range report.Keys {
+
+		primary := ""
+		if i == 0 || report.Keys[i-1].Prefix != k.Prefix {
+			primary = " (primary)"
+		}
+
+		prefix := ""
+		if k.Prefix != "" {
+			prefix = " for " + k.Prefix
+		}
+
+		fmt.Printf("key %s%s%s: %d values\n", k.KeyID, prefix, primary, len(k.Values))
+		for _, vaultKey := range k.Values {
+			fmt.Printf("    %s\n", vaultKey)
+		}
+	}
+
+	fmt.Printf("unencrypted: %d values\n", len(report.Unencrypted))
+	for _, vaultKey := range report.Unencrypted {
+		fmt.Printf("    %s\n", vaultKey)
+	}
+
+	fmt.Printf("undecryptable: %d values\n", len(report.Undecryptable))
+	for _, err := range report.Undecryptable {
+		fmt.Printf("    %s\n", err)
+	}
+
 	return nil
 }
 
-func putDataAtKey(rootDir string, key string, data string) error {
+/*
+A negative ifVersion puts the data unconditionally, otherwise the put fails
+if the data revision has changed.
+*/
+func putDataAtKey(rootDir string, key string, data string, ifVersion int64) error {
+
+	vault, err := openVault(rootDir)
+	if err != nil {
+		log.Println("putDataAtKey():", err)
+		return err
+	}
+
+	defer vault.Close()
+
+	if ifVersion >= 0 {
+		err = vault.PutIfVersion(key, []byte(data), uint64(ifVersion))
+	} else {
+		lock := vault.LockKey(key)
+		err = vault.Put(key, []byte(data))
+		lock.Unlock()
+	}
 
-	err := fsvault.Put(rootDir, key, []byte(data))
 	if err != nil {
 		log.Println("putDataAtKey():", err)
 		return err
@@ -133,22 +443,55 @@ func putDataAtKey(rootDir string, key string, data string) error {
 	return nil
 }
 
-func getDataAtKey(rootDir string, key string) error {
+func getDataAtKey(rootDir string, key string, version bool) error {
 
-	data, err := fsvault.Get(rootDir, key)
+	vault, err := openVault(rootDir)
 	if err != nil {
 		log.Println("getDataAtKey():", err)
 		return err
 	}
 
-	fmt.Printf("%s\n", string(data))
+	defer vault.Close()
+
+	if version {
+		_, revision, err := vault.GetVersioned(key)
+		if err != nil {
+			log.Println("getDataAtKey():", err)
+			return err
+		}
+
+		fmt.Printf("%d\n", revision)
+		return nil
+	}
+
+	// write the data straight out, so it's wiped without a copy left behind
+	err = vault.GetSecret(key, func(data []byte) error {
+		os.Stdout.Write(data)
+		fmt.Println()
+		return nil
+	})
+	if err != nil {
+		log.Println("getDataAtKey():", err)
+		return err
+	}
 
 	return nil
 }
 
 func deleteDataAtKey(rootDir string, key string) error {
 
-	err := fsvault.Delete(rootDir, key)
+	vault, err := openVault(rootDir)
+	if err != nil {
+		log.Println("deleteDataAtKey():", err)
+		return err
+	}
+
+	defer vault.Close()
+
+	lock := vault.LockKey(key)
+	defer lock.Unlock()
+
+	err = vault.Delete(key)
 	if err != nil {
 		fmt.Printf("delete failed because %s\n", err.Error())
 	} else {
@@ -160,7 +503,15 @@ func deleteDataAtKey(rootDir string, key string) error {
 
 func listDataAtKey(rootDir string, key string) error {
 
-	data := fsvault.List(rootDir, key)
+	vault, err := openVault(rootDir)
+	if err != nil {
+		log.Println("listDataAtKey():", err)
+		return err
+	}
+
+	defer vault.Close()
+
+	data := vault.List(key)
 
 	for _, k := range data {
 		fmt.Printf("%s\n", k)
@@ -8,6 +8,18 @@ import (
 var defaultValues = map[string]interface{}{
 	"FSVAULT_DATADIR":     "/tmp",
 	"FSVAULT_SECRET_KEYS": "",
+
+	"FSVAULT_SECRET_KEYS_FILE":    "",
+	"FSVAULT_SECRET_KEYS_COMMAND": "",
+	"FSVAULT_CIPHER":              "AES-GCM",
+
+	"FSVAULT_REQUIRE_ENCRYPTION": false,
+	"FSVAULT_ENCRYPT_NAMES":      false,
+	"FSVAULT_CHECKSUMS":          false,
+	"FSVAULT_INTEGRITY_KEY":      "",
+	"FSVAULT_UNCHECKED_READS":    false,
+	"FSVAULT_ROTATE_ON_READ":     "lazy",
+	"FSVAULT_LOCK_FILES":         false,
 }
 
 func StringValue(key string) string {
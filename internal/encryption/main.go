@@ -5,13 +5,21 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
-func Encrypt(key string, data []byte) ([]byte, error) {
+func Encrypt(key []byte, data []byte) ([]byte, error) {
+	return EncryptWithAD(key, data, nil)
+}
+
+// EncryptWithAD encrypts data with AES-GCM, authenticating additionalData
+// alongside it. The same additionalData must be given to DecryptWithAD.
+func EncryptWithAD(key []byte, data []byte, additionalData []byte) ([]byte, error) {
 
 	var cipherData []byte
 
-	aes, err := aes.NewCipher([]byte(key))
+	aes, err := aes.NewCipher(key)
 	if err != nil {
 		return cipherData, errors.New(err.Error())
 	}
@@ -21,20 +29,18 @@ func Encrypt(key string, data []byte) ([]byte, error) {
 		return cipherData, errors.New(err.Error())
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	_, err = rand.Read(nonce)
-	if err != nil {
-		return cipherData, errors.New(err.Error())
-	}
-
-	cipherData = gcm.Seal(nonce, nonce, data, nil)
+	return Seal(gcm, data, additionalData)
+}
 
-	return cipherData, nil
+func Decrypt(key []byte, data []byte) ([]byte, error) {
+	return DecryptWithAD(key, data, nil)
 }
 
-func Decrypt(key string, data []byte) ([]byte, error) {
+// DecryptWithAD decrypts AES-GCM data, failing if additionalData doesn't
+// match that given to EncryptWithAD.
+func DecryptWithAD(key []byte, data []byte, additionalData []byte) ([]byte, error) {
 
-	aes, err := aes.NewCipher([]byte(key))
+	aes, err := aes.NewCipher(key)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -44,14 +50,46 @@ func Decrypt(key string, data []byte) ([]byte, error) {
 		return []byte{}, err
 	}
 
-	nonceSize := gcm.NonceSize()
+	return Open(gcm, data, additionalData)
+}
+
+// NewChaCha20Poly1305 returns a ChaCha20-Poly1305 AEAD, which needs a 32
+// byte key.
+func NewChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
+}
+
+// Seal encrypts data with a random nonce, which is prepended to the
+// returned ciphertext.
+func Seal(aead cipher.AEAD, data []byte, additionalData []byte) ([]byte, error) {
+
+	var cipherData []byte
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return cipherData, errors.New(err.Error())
+	}
+
+	cipherData = aead.Seal(nonce, nonce, data, additionalData)
+
+	return cipherData, nil
+}
+
+// Open decrypts data returned by Seal.
+func Open(aead cipher.AEAD, data []byte, additionalData []byte) ([]byte, error) {
+
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize {
+		return []byte{}, errors.New("ciphertext too short")
+	}
+
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
 
-	decryptedBytes, err := gcm.Open(nil, []byte(nonce), []byte(ciphertext), nil)
+	decryptedBytes, err := aead.Open(nil, []byte(nonce), []byte(ciphertext), additionalData)
 	if err != nil {
 		return []byte{}, err
 	}
 
 	return decryptedBytes, nil
-
 }
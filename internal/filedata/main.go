@@ -1,6 +1,11 @@
 package filedata
 
 type FileData struct {
-	Data   []byte `json:"data"`
-	Cipher string `json:"cipher"`
+	Data     []byte `json:"data"`
+	Cipher   string `json:"cipher"`
+	KeyID    string `json:"keyid,omitempty"`
+	DataKey  []byte `json:"datakey,omitempty"`
+	Revision uint64 `json:"revision,omitempty"`
+	Version  int    `json:"version,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
 }
@@ -0,0 +1,123 @@
+package securemem
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// Buffer holds secret bytes on memory pages of their own, locked into
+// memory where the platform allows so they aren't written to swap, until
+// Wipe zeroes them. Go strings, and slices the runtime may have copied,
+// can't be reliably wiped, so secrets should only be kept in a Buffer.
+//
+// The garbage collector doesn't zero memory, so a Buffer must be wiped once
+// it is no longer needed. As a backstop, a Buffer that is garbage collected
+// without being wiped is wiped then, which may be much later.
+type Buffer struct {
+	mu     sync.Mutex
+	b      []byte
+	pages  []byte // the whole pages holding b
+	locked bool
+}
+
+// New returns a zeroed buffer of size bytes.
+func New(size int) *Buffer {
+
+	s := &Buffer{b: []byte{}}
+
+	if size == 0 {
+		return s
+	}
+
+	// pad the allocation so b can start on a page boundary, and no other
+	// data shares its pages, which are locked and unlocked as a whole
+	page := os.Getpagesize()
+	pages := (size + page - 1) / page
+	raw := make([]byte, (pages+1)*page)
+
+	offset := page - int(uintptr(unsafe.Pointer(&raw[0]))%uintptr(page))
+	if offset == page {
+		offset = 0
+	}
+
+	s.pages = raw[offset : offset+pages*page]
+	s.b = s.pages[:size:size]
+	s.locked = lock(s.pages)
+
+	runtime.SetFinalizer(s, (*Buffer).Wipe)
+
+	return s
+}
+
+// Copy returns a buffer holding a copy of b.
+func Copy(b []byte) *Buffer {
+
+	s := New(len(b))
+	copy(s.b, b)
+
+	return s
+}
+
+// Move returns a buffer holding b, and zeroes b.
+func Move(b []byte) *Buffer {
+
+	s := Copy(b)
+	clear(b)
+
+	return s
+}
+
+// Bytes returns the secret, which is zeroed by Wipe. A nil or wiped buffer
+// returns nil.
+func (s *Buffer) Bytes() []byte {
+
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.b
+}
+
+// Locked returns true if the buffer is locked into memory.
+func (s *Buffer) Locked() bool {
+
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.locked
+}
+
+// Wipe zeroes the buffer, and unlocks its pages. It is safe to call more
+// than once.
+func (s *Buffer) Wipe() {
+
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.b == nil {
+		return
+	}
+
+	clear(s.pages)
+
+	if s.locked {
+		unlock(s.pages)
+		s.locked = false
+	}
+
+	s.b = nil
+	s.pages = nil
+}
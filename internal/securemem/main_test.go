@@ -0,0 +1,56 @@
+//go:build dev
+
+package securemem
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuffer(t *testing.T) {
+
+	source := []byte("eheheheheheheheheheheheheheheheh")
+	s := Move(source)
+
+	assert.Equal(t, make([]byte, len(source)), source, "source zeroed")
+	assert.Equal(t, "eheheheheheheheheheheheheheheheh", string(s.Bytes()), "moved")
+
+	// the secret has its pages to itself
+	secret := s.Bytes()
+	address := uintptr(unsafe.Pointer(&secret[0]))
+	assert.Equal(t, uintptr(0), address%uintptr(os.Getpagesize()), "page aligned")
+
+	s.Wipe()
+
+	assert.Equal(t, make([]byte, len(secret)), secret, "wiped")
+	assert.Nil(t, s.Bytes(), "wiped")
+	assert.False(t, s.Locked(), "unlocked")
+
+	// wiping twice, or a nil buffer, is fine
+	s.Wipe()
+	var empty *Buffer
+	empty.Wipe()
+	assert.Nil(t, empty.Bytes(), "nil buffer")
+
+	assert.Equal(t, 0, len(Copy(nil).Bytes()), "empty buffer")
+}
+
+func TestBufferGarbageCollected(t *testing.T) {
+
+	s := Copy([]byte("eheheheheheheheheheheheheheheheh"))
+	secret := s.Bytes()
+	s = nil
+
+	// finalizers run on their own goroutine, after a collection
+	for i := 0; i < 50 && secret[0] != 0; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, make([]byte, len(secret)), secret, "wiped when collected")
+}
@@ -0,0 +1,13 @@
+//go:build !(darwin || linux)
+
+package securemem
+
+// lock isn't supported on this platform, so the buffer can still be wiped
+// but may be swapped to disk.
+func lock(b []byte) bool {
+	return false
+}
+
+// unlock isn't supported on this platform.
+func unlock(b []byte) {
+}
@@ -0,0 +1,18 @@
+//go:build darwin || linux
+
+package securemem
+
+import (
+	"syscall"
+)
+
+// lock locks the pages of b into memory, returning false if it can't,
+// usually because of RLIMIT_MEMLOCK.
+func lock(b []byte) bool {
+	return syscall.Mlock(b) == nil
+}
+
+// unlock unlocks the pages of b.
+func unlock(b []byte) {
+	syscall.Munlock(b)
+}
@@ -0,0 +1,137 @@
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// Shamir's secret sharing over GF(2^8), splitting each byte of the secret
+// separately. A share is the value of each byte's polynomial at x, followed
+// by x itself.
+
+// Split splits secret into n shares, any k of which give the secret back
+// from Combine. Fewer than k shares tell nothing about the secret.
+func Split(secret []byte, n int, k int) ([][]byte, error) {
+
+	if len(secret) == 0 {
+		return nil, errors.New("secret is empty")
+	}
+
+	if k < 2 || k > n || n > 255 {
+		return nil, errors.New("need 2 <= threshold <= shares <= 255")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1) // x, never 0
+	}
+
+	// coefficients of the polynomial for one byte, coefficients[0] is the
+	// byte of the secret
+	coefficients := make([]byte, k)
+
+	for b, s := range secret {
+
+		coefficients[0] = s
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		for _, share := range shares {
+			share[b] = evaluate(coefficients, share[len(secret)])
+		}
+	}
+
+	return shares, nil
+}
+
+// Combine returns the secret from shares returned by Split. With fewer than
+// the threshold of shares the result is not the secret, and nothing reports
+// that, so check the result.
+func Combine(shares [][]byte) ([]byte, error) {
+
+	if len(shares) < 2 {
+		return nil, errors.New("need at least 2 shares")
+	}
+
+	size := len(shares[0])
+	if size < 2 {
+		return nil, errors.New("share is too short")
+	}
+
+	seen := map[byte]bool{}
+
+	for _, share := range shares {
+
+		if len(share) != size {
+			return nil, errors.New("shares are different lengths")
+		}
+
+		x := share[size-1]
+		if x == 0 || seen[x] {
+			return nil, errors.New("invalid or repeated share")
+		}
+		seen[x] = true
+	}
+
+	secret := make([]byte, size-1)
+
+	// Lagrange interpolation at x = 0, where subtraction is xor
+	for i, share := range shares {
+
+		xi := share[size-1]
+		basis := byte(1)
+
+		for j, other := range shares {
+			if i != j {
+				xj := other[size-1]
+				basis = mul(basis, div(xj, xj^xi))
+			}
+		}
+
+		for b := range secret {
+			secret[b] ^= mul(share[b], basis)
+		}
+	}
+
+	return secret, nil
+}
+
+// evaluate returns the polynomial with coefficients at x.
+func evaluate(coefficients []byte, x byte) byte {
+
+	var y byte
+
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coefficients[i]
+	}
+
+	return y
+}
+
+// mul multiplies in GF(2^8) with the AES polynomial, without tables or
+// branches on secret data that could leak through timing.
+func mul(a byte, b byte) byte {
+
+	var p byte
+
+	for i := 0; i < 8; i++ {
+		p ^= a & -(b & 1)
+		a = a<<1 ^ 0x1b&-(a>>7)
+		b >>= 1
+	}
+
+	return p
+}
+
+// div divides a by b, which must not be 0. The inverse of b is b^254.
+func div(a byte, b byte) byte {
+
+	inverse := b
+	for i := 0; i < 6; i++ {
+		inverse = mul(mul(inverse, inverse), b)
+	}
+
+	return mul(a, mul(inverse, inverse))
+}
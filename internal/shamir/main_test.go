@@ -0,0 +1,71 @@
+//go:build dev
+
+package shamir
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitCombine(t *testing.T) {
+
+	secret := []byte("eheheheheheheheheheheheheheheheh")
+
+	shares, err := Split(secret, 5, 3)
+	assert.Equal(t, nil, err, "split")
+	assert.Equal(t, 5, len(shares), "split")
+
+	// any 3 shares give the secret
+	for _, picked := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+
+		subset := [][]byte{}
+		for _, i := range picked {
+			subset = append(subset, shares[i])
+		}
+
+		combined, err := Combine(subset)
+		assert.Equal(t, nil, err, picked)
+		assert.Equal(t, secret, combined, picked)
+	}
+
+	// 2 shares don't
+	combined, err := Combine(shares[:2])
+	assert.Equal(t, nil, err, "below threshold")
+	assert.NotEqual(t, secret, combined, "below threshold")
+}
+
+func TestSplitCombineErrors(t *testing.T) {
+
+	secret := []byte("eheheheheheheheheheheheheheheheh")
+
+	_, err := Split(secret, 3, 4)
+	assert.NotEqual(t, nil, err, "threshold above shares")
+
+	_, err = Split(secret, 3, 1)
+	assert.NotEqual(t, nil, err, "threshold of 1")
+
+	_, err = Split([]byte{}, 3, 2)
+	assert.NotEqual(t, nil, err, "empty secret")
+
+	shares, _ := Split(secret, 3, 2)
+
+	_, err = Combine([][]byte{shares[0], shares[0]})
+	assert.NotEqual(t, nil, err, "repeated share")
+
+	_, err = Combine([][]byte{shares[0], shares[1][1:]})
+	assert.NotEqual(t, nil, err, "different lengths")
+
+	_, err = Combine([][]byte{shares[0]})
+	assert.NotEqual(t, nil, err, "one share")
+}
+
+func TestMul(t *testing.T) {
+
+	// from FIPS-197, section 4.2
+	assert.Equal(t, byte(0xc1), mul(0x57, 0x83), "mul")
+
+	for b := 1; b < 256; b++ {
+		assert.Equal(t, byte(1), mul(byte(b), div(1, byte(b))), "inverse")
+	}
+}